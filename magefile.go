@@ -56,36 +56,49 @@ func BuildWithCustomConfig() {
 	mageutil.Build(bin, config)
 }
 
+// Start starts the tools and services, or the given ones, --env selects an overlay of start-config.yml.
+//
+// Example: `mage start --env staging openim-api`
 func Start() {
-	mageutil.InitForSSC()
-	err := setMaxOpenFiles()
-	if err != nil {
-		mageutil.PrintRed("setMaxOpenFiles failed " + err.Error())
-		os.Exit(1)
-	}
-
 	flag.Parse()
 	bin := flag.Args()
 	if len(bin) != 0 {
 		bin = bin[1:]
 	}
+	bin, err := mageutil.ParseEnvFlag(bin)
+	if err != nil {
+		mageutil.PrintRed("Invalid start arguments: " + err.Error())
+		os.Exit(1)
+	}
 
-	mageutil.StartToolsAndServices(bin, nil)
-}
-
-func StartWithCustomConfig() {
 	mageutil.InitForSSC()
-	err := setMaxOpenFiles()
+	err = setMaxOpenFiles()
 	if err != nil {
 		mageutil.PrintRed("setMaxOpenFiles failed " + err.Error())
 		os.Exit(1)
 	}
 
+	mageutil.StartToolsAndServices(bin, nil)
+}
+
+func StartWithCustomConfig() {
 	flag.Parse()
 	bin := flag.Args()
 	if len(bin) != 0 {
 		bin = bin[1:]
 	}
+	bin, err := mageutil.ParseEnvFlag(bin)
+	if err != nil {
+		mageutil.PrintRed("Invalid start arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	mageutil.InitForSSC()
+	err = setMaxOpenFiles()
+	if err != nil {
+		mageutil.PrintRed("setMaxOpenFiles failed " + err.Error())
+		os.Exit(1)
+	}
 
 	config := &mageutil.PathOptions{
 		RootDir:   &customRootDir,   // default is "."(current directory)
@@ -96,12 +109,229 @@ func StartWithCustomConfig() {
 	mageutil.StartToolsAndServices(bin, config)
 }
 
+// Stop stops all services or the given `service` and `service:index` instances, --orphans only stops the
+// unexpected processes reported by check.
+//
+// Example: `mage stop openim-api openim-rpc-user:1`, `mage stop --orphans`
 func Stop() {
-	mageutil.StopAndCheckBinaries()
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Stop(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
 }
 
+// Check checks that all services, or the given `service` and `service:index` instances, are running and healthy.
+//
+// Example: `mage check openim-api:0`
 func Check() {
-	mageutil.CheckAndReportBinariesStatus()
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Check(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Status prints a table of the instances with their resource usage, ports, restarts and health.
+//
+// Example: `mage status --json`, `mage status --watch --interval 5s`
+func Status() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Status(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Top shows a live view of the instances' resource usage, with keys to restart, stop or tail the selected one.
+func Top() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Top(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Restart restarts the specified services, or all of them, one instance at a time with --rolling.
+//
+// Example: `mage restart openim-api --rolling`
+func Restart() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Restart(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Scale starts or stops instances to match the given counts, --save writes them to start-config.yml.
+//
+// Example: `mage scale openim-rpc-msg=4 openim-api=2 --save`
+func Scale() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Scale(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Supervise starts the services and restarts crashed instances according to their restart policy.
+//
+// Example: `mage supervise --daemon`
+func Supervise() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Supervise(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Logs prints the output of service instances merged in timestamp order.
+//
+// Example: `mage logs openim-api:0 openim-rpc-user -f --since 10m --level error`
+func Logs() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Logs(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Graph prints the service dependency graph in DOT format.
+//
+// Example: `mage graph | dot -Tsvg -o graph.svg`
+func Graph() {
+	mageutil.Graph()
+}
+
+// Test runs go test for the packages imported by the specified binaries, or for every module.
+//
+// Example: `mage test openim-api -race -cover`
+func Test() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Test(args, nil)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Config manages start-config.yml, show prints it merged with the overlay of --env or GOMAKE_ENV and validate
+// checks it, exiting non-zero on errors.
+//
+// Example: `mage config sync --prune`, `mage config show --env staging`, `mage config validate --strict`
+func Config() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.ConfigCommand(args)
+	// The subcommand and its flags are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Install copies the host binaries, config and start-config.yml into a bin/, etc/, var/log/ layout.
+//
+// Example: `mage install --prefix /opt/openim`, DESTDIR is honored for staging.
+func Install() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Install(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Uninstall removes exactly the files recorded by a previous install.
+//
+// Example: `mage uninstall --prefix /opt/openim`
+func Uninstall() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Uninstall(args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Deb builds a Debian package of the binaries, config and systemd units.
+//
+// Example: `mage deb --platform linux_arm64`
+func Deb() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Package("deb", args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Rpm builds an RPM package of the binaries, config and systemd units.
+//
+// Example: `mage rpm --version 1.2.0`
+func Rpm() {
+	flag.Parse()
+	args := flag.Args()
+	if len(args) != 0 {
+		args = args[1:]
+	}
+
+	mageutil.Package("rpm", args)
+	// The arguments are no mage targets, exit before mage tries to run them.
+	os.Exit(0)
+}
+
+// Keygen generates an ed25519 key pair for signing the binary manifests written by build.
+func Keygen() {
+	if err := mageutil.GenerateSigningKey(mageutil.Paths.Root); err != nil {
+		mageutil.PrintRed("Failed to generate signing key: " + err.Error())
+		os.Exit(1)
+	}
 }
 
 func Protocol() {
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// TestConfigExitStatus runs `mage config` subcommands through mage, whose remaining arguments must not be taken
+// for unknown targets.
+func TestConfigExitStatus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("compiles the magefile")
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := t.TempDir()
+	mage := filepath.Join(cache, "mage")
+	if runtime.GOOS == "windows" {
+		mage += ".exe"
+	}
+	if out, err := exec.Command("go", "build", "-o", mage, "github.com/magefile/mage").CombinedOutput(); err != nil {
+		t.Fatalf("failed to build mage: %v\n%s", err, out)
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		args   []string
+		status int
+	}{
+		{"validate", "serviceBinaries: {}\n", []string{"config", "validate"}, 0},
+		{"validate strict", "serviceBinaries: {}\n", []string{"config", "validate", "--strict"}, 0},
+		{"show env", "serviceBinaries: {}\n", []string{"config", "show", "--env", "staging"}, 0},
+		{"invalid config", "serviceBinaries:\n  api: many\n", []string{"config", "validate"}, 1},
+		{"unknown subcommand", "serviceBinaries: {}\n", []string{"config", "check"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "start-config.yml"), []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "start-config.staging.yml"), []byte("serviceBinaries: {}\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			cmd := exec.Command(mage, append([]string{"-d", root, "-w", dir}, tt.args...)...)
+			cmd.Dir = root
+			cmd.Env = append(os.Environ(), "MAGEFILE_CACHE="+cache)
+			out, err := cmd.CombinedOutput()
+
+			status := 0
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				status = exitErr.ExitCode()
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != tt.status {
+				t.Errorf("mage %v exited with %d, want %d\n%s", tt.args, status, tt.status, out)
+			}
+		})
+	}
+}
@@ -6,18 +6,31 @@
 package main
 
 import (
+	"fmt"
 	"syscall"
 
 	"github.com/openimsdk/gomake/mageutil"
 )
 
+// setMaxOpenFiles raises the open files limit inherited by the services, capped at the hard limit when it can't
+// be raised.
 func setMaxOpenFiles() error {
+	if mageutil.MaxFileDescriptors <= 0 {
+		return nil
+	}
 	var rLimit syscall.Rlimit
 	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 	if err != nil {
 		return err
 	}
+	hard := rLimit.Max
 	rLimit.Max = uint64(mageutil.MaxFileDescriptors)
 	rLimit.Cur = uint64(mageutil.MaxFileDescriptors)
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err == nil || rLimit.Max <= hard {
+		return err
+	}
+	mageutil.PrintYellow(fmt.Sprintf("maxFileDescriptors %d exceeds the hard limit, capped at %d", mageutil.MaxFileDescriptors, hard))
+	rLimit.Max = hard
+	rLimit.Cur = hard
 	return syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit)
 }
@@ -0,0 +1,34 @@
+package mageutil
+
+import (
+	"flag"
+	"io"
+)
+
+// parseArgs parses flags from args while allowing them to be mixed with positional arguments,
+// e.g. `mage test openim-api -race openim-rpc-user`. The positional arguments are returned in order.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+// newFlagSet returns a flag set for a mage target that reports errors instead of exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Func("env", "environment overlay of start-config.yml, e.g. staging", func(env string) error {
+		configEnvironment = env
+		return nil
+	})
+	return fs
+}
@@ -13,19 +13,50 @@ import (
 	"github.com/magefile/mage/sh"
 )
 
+// Check checks the given `service` or `service:index` instances, or all of them, e.g. `mage check openim-api:0`.
+func Check(args []string) {
+	flags := newFlagSet("check")
+	targets, err := parseArgs(flags, args)
+	if err != nil {
+		PrintRed("Invalid check arguments: " + err.Error())
+		os.Exit(1)
+	}
+	InitForSSC()
+	selection, err := parseInstanceSelection(targets)
+	if err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+	checkAndReportInstances(selection)
+}
+
 // CheckAndReportBinariesStatus checks the running status of all binary files and reports it.
 func CheckAndReportBinariesStatus() {
 	InitForSSC()
-	err := CheckBinariesRunning()
+	checkAndReportInstances(allInstances())
+}
+
+// checkAndReportInstances checks that the selected instances are running and healthy and prints their ports.
+func checkAndReportInstances(selection instanceSelection) {
+	reportStrayProcesses(selection)
+	err := checkInstancesRunning(selection)
 	if err != nil {
 		PrintRed("Some programs are not running properly:")
 		PrintRedNoTimeStamp(err.Error())
 		os.Exit(1)
 	}
-	PrintGreen("All services are running normally.")
+	if err := checkInstancesHealth(selection); err != nil {
+		PrintRed("Some programs are not healthy:")
+		PrintRedNoTimeStamp(err.Error())
+		os.Exit(1)
+	}
+	if selection.complete() {
+		PrintGreen("All services are running normally.")
+	} else {
+		PrintGreen(fmt.Sprintf("The selected instances are running normally: %s", selection))
+	}
 	PrintBlue("Display details of the ports listened to by the service:")
-	time.Sleep(1 * time.Second)
-	err = PrintListenedPortsByBinaries()
+	err = printListenedPorts(selection)
 	if err != nil {
 		PrintRed("PrintListenedPortsByBinaries error")
 		PrintRedNoTimeStamp(err.Error())
@@ -33,6 +64,74 @@ func CheckAndReportBinariesStatus() {
 	}
 }
 
+// Stop stops the given `service` or `service:index` instances, all services, or only the orphan processes reported
+// by mage check, e.g. `mage stop openim-api:1` or `mage stop --orphans`.
+func Stop(args []string) {
+	flags := newFlagSet("stop")
+	orphans := flags.Bool("orphans", false, "only stop processes from the output directory that are not expected instances")
+	targets, err := parseArgs(flags, args)
+	if err != nil {
+		PrintRed("Invalid stop arguments: " + err.Error())
+		os.Exit(1)
+	}
+	if *orphans && len(targets) > 0 {
+		PrintRed("Invalid stop arguments: --orphans doesn't take services")
+		os.Exit(1)
+	}
+	if !*orphans && len(targets) == 0 {
+		StopAndCheckBinaries()
+		return
+	}
+	InitForSSC()
+	if *orphans {
+		err = StopOrphans()
+	} else {
+		var selection instanceSelection
+		if selection, err = parseInstanceSelection(targets); err == nil {
+			err = stopInstances(selection)
+		}
+	}
+	if err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+}
+
+// stopInstances stops the selected instances in reverse dependency order and leaves the others running.
+func stopInstances(selection instanceSelection) error {
+	if sup := runningSupervisor(); sup != nil {
+		return fmt.Errorf("a supervisor is running with pid %d and would restart the instances, stop everything with `mage stop` instead", sup.PID)
+	}
+	procs, err := selectedProcesses(selection)
+	if err != nil {
+		return err
+	}
+	stopServiceProcessesInOrder(procs)
+
+	const maxAttempts = 10
+	for i := 0; ; i++ {
+		if procs, err = selectedProcesses(selection); err != nil {
+			return err
+		}
+		var running []string
+		for _, service := range selection.services() {
+			if len(procs[service]) > 0 {
+				running = append(running, service)
+			}
+		}
+		if len(running) == 0 {
+			break
+		}
+		if i == maxAttempts-1 {
+			return fmt.Errorf("some services are still running after they were stopped: %s", strings.Join(running, ", "))
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	pruneStateFile()
+	PrintGreen(fmt.Sprintf("Stopped %s", selection))
+	return nil
+}
+
 // StopAndCheckBinaries stops all binary processes and checks if they have all stopped.
 func StopAndCheckBinaries() {
 	InitForSSC()
@@ -42,24 +141,25 @@ func StopAndCheckBinaries() {
 		PrintRed(err.Error())
 		return
 	}
+	pruneStateFile()
 	PrintGreen("All services have been stopped")
 }
 
+// attemptCheckBinaries verifies that no service is running anymore. KillExistBinaries already waited for every
+// instance to exit or killed it, so this only gives the system a moment to reap killed processes.
 func attemptCheckBinaries() error {
-	const maxAttempts = 15
+	const maxAttempts = 10
 	var err error
 	for i := 0; i < maxAttempts; i++ {
 		err = CheckBinariesStop()
 		if err == nil {
 			return nil
 		}
-		PrintYellow("Some services have not been stopped, details are as follows: " + err.Error())
-		PrintYellow("Continue to wait for 1 second before checking again")
 		if i < maxAttempts-1 {
-			time.Sleep(1 * time.Second) // Sleep for 1 second before retrying
+			time.Sleep(500 * time.Millisecond)
 		}
 	}
-	return fmt.Errorf("already waited for %d seconds, some services have still not stopped", maxAttempts)
+	return fmt.Errorf("some services are still running after they were stopped: %v", err)
 }
 
 // StartToolsAndServices starts the process for tools and services.
@@ -202,6 +302,9 @@ func CompileForPlatform(cgoEnabled string, platform string, compileBinaries []st
 		// PrintBlue(fmt.Sprintf("Source directory: %s", filepath.Join(Paths.Root, Paths.SrcDir)))
 		// PrintBlue(fmt.Sprintf("Output directory: %s", Paths.OutputBinPath))
 		cmdCompiledDirs = compileDir(cgoEnabled, filepath.Join(Paths.Root, Paths.SrcDir), Paths.OutputBinPath, platform, cmdBinaries)
+		if err := buildLogHelper(platform); err != nil {
+			PrintYellow(fmt.Sprintf("Instance logs of %s won't be rotated: %v", platform, err))
+		}
 	}
 
 	if len(toolsBinaries) > 0 {
@@ -215,7 +318,7 @@ func CompileForPlatform(cgoEnabled string, platform string, compileBinaries []st
 }
 
 func createStartConfigYML(cmdDirs, toolsDirs []string) {
-	configPath := filepath.Join(Paths.Root, StartConfigFile)
+	configPath := startConfigPath()
 
 	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
 		PrintBlue("start-config.yml already exists, skipping creation.")
@@ -407,8 +510,19 @@ func compileDir(cgoEnabled string, sourceDir, outputBase, platform string, compi
 	}
 
 	compiledDirs := make([]string, 0, len(compileBinaries))
+	compiledFiles := make([]string, 0, len(compileBinaries))
 	for str := range res {
 		compiledDirs = append(compiledDirs, str)
+		if targetOS == "windows" {
+			compiledFiles = append(compiledFiles, str+".exe")
+		} else {
+			compiledFiles = append(compiledFiles, str)
+		}
+	}
+
+	if err := updateBinaryManifest(outputDir, platform, compiledFiles); err != nil {
+		PrintRed("Failed to update binary manifest: " + err.Error())
+		os.Exit(1)
 	}
 	return compiledDirs
 }
@@ -438,6 +552,7 @@ func Build(binaries []string, pathOpts *PathOptions) {
 	for _, platform := range strings.Split(platforms, " ") {
 		CompileForPlatform(cgoEnabled, platform, compileBinaries)
 	}
+	syncStartConfigAfterBuild()
 	PrintGreen("All specified binaries under cmd and tools were successfully compiled.")
 }
 
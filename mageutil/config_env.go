@@ -0,0 +1,140 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigEnvironmentEnv selects the environment overlay of start-config.yml, like the --env flag.
+const ConfigEnvironmentEnv = "GOMAKE_ENV"
+
+// configEnvironment is the environment selected with --env, it takes precedence over GOMAKE_ENV.
+var configEnvironment string
+
+// configEnvironmentName returns the selected environment, empty when only start-config.yml is used.
+func configEnvironmentName() string {
+	if configEnvironment != "" {
+		return configEnvironment
+	}
+	return os.Getenv(ConfigEnvironmentEnv)
+}
+
+// ParseEnvFlag removes `--env <name>` and `--env=<name>` from the arguments of targets that don't parse flags and
+// selects that environment, e.g. `mage start --env staging openim-api`.
+func ParseEnvFlag(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "env" {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag needs an argument: --env")
+			}
+			i++
+			value = args[i]
+		}
+		configEnvironment = value
+	}
+	return rest, nil
+}
+
+// overlayConfigPath returns the overlay of an environment next to start-config.yml, e.g. start-config.staging.yml.
+func overlayConfigPath(env string) string {
+	base := startConfigPath()
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "." + env + ext
+}
+
+// loadStartConfigNode reads start-config.yml and deep-merges the overlay of the selected environment over it.
+// It returns the merged document and the files it was read from.
+func loadStartConfigNode() (*yaml.Node, []string, error) {
+	path := startConfigPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading YAML file: %v", err)
+	}
+	doc, err := parseStartConfigNode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	sources := []string{path}
+
+	env := configEnvironmentName()
+	if env == "" {
+		return doc, sources, nil
+	}
+	overlayPath := overlayConfigPath(env)
+	data, err = os.ReadFile(overlayPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading the overlay of environment %s: %v", env, err)
+	}
+	overlay, err := parseStartConfigNode(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", overlayPath, err)
+	}
+	mergeConfigNodes(doc.Content[0], overlay.Content[0], nil)
+	return doc, append(sources, overlayPath), nil
+}
+
+// mergeConfigNodes merges the overlay mapping into base: mappings are merged key by key, any other value of the
+// overlay, including lists, replaces the base value. A service written as the `name: count` shorthand on one side
+// and as a mapping on the other is merged as a mapping with that count.
+func mergeConfigNodes(base, overlay *yaml.Node, path []string) {
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		var existing *yaml.Node
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				existing = base.Content[j+1]
+				break
+			}
+		}
+		if existing == nil {
+			base.Content = append(base.Content, key, value)
+			continue
+		}
+
+		if len(path) == 1 && path[0] == "serviceBinaries" {
+			if existing.Kind == yaml.ScalarNode && value.Kind == yaml.MappingNode {
+				count := *existing
+				*existing = *countMappingNode(&count)
+			} else if existing.Kind == yaml.MappingNode && value.Kind == yaml.ScalarNode {
+				value = countMappingNode(value)
+			}
+		}
+		if existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			mergeConfigNodes(existing, value, append(path, key.Value))
+		} else {
+			*existing = *value
+		}
+	}
+}
+
+// countMappingNode turns the `name: count` shorthand of a service into its mapping form.
+func countMappingNode(count *yaml.Node) *yaml.Node {
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "count"}, count,
+	}}
+}
+
+// showConfig prints the effective start-config.yml, with the overlay of the selected environment merged in.
+func showConfig() error {
+	doc, sources, err := loadStartConfigNode()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# Effective configuration from %s\n", strings.Join(sources, " + "))
+	encoder := yaml.NewEncoder(os.Stdout)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error marshalling YAML: %w", err)
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,85 @@
+package mageutil
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeConfigNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "scalar replaced",
+			base:    "maxFileDescriptors: 1024\n",
+			overlay: "maxFileDescriptors: 4096\n",
+			want:    "maxFileDescriptors: 4096\n",
+		},
+		{
+			name:    "key added",
+			base:    "maxFileDescriptors: 1024\n",
+			overlay: "cgroup: staging\n",
+			want:    "maxFileDescriptors: 1024\ncgroup: staging\n",
+		},
+		{
+			name:    "mappings merged key by key",
+			base:    "logs: {maxSize: 100, compress: true}\n",
+			overlay: "logs: {maxSize: 10}\n",
+			want:    "logs: {maxSize: 10, compress: true}\n",
+		},
+		{
+			name:    "lists replaced",
+			base:    "toolBinaries: [a, b]\n",
+			overlay: "toolBinaries: [c]\n",
+			want:    "toolBinaries: [c]\n",
+		},
+		{
+			name:    "shorthand count merged with a mapping",
+			base:    "serviceBinaries: {api: 2, rpc: 1}\n",
+			overlay: "serviceBinaries: {api: {port: 10002}}\n",
+			want:    "serviceBinaries: {api: {count: 2, port: 10002}, rpc: 1}\n",
+		},
+		{
+			name:    "mapping merged with a shorthand count",
+			base:    "serviceBinaries: {api: {count: 2, port: 10002}}\n",
+			overlay: "serviceBinaries: {api: 4}\n",
+			want:    "serviceBinaries: {api: {count: 4, port: 10002}}\n",
+		},
+		{
+			name:    "shorthand only applies to services",
+			base:    "logs: 1\n",
+			overlay: "logs: {maxSize: 10}\n",
+			want:    "logs: {maxSize: 10}\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := parseStartConfigNode([]byte(tt.base))
+			if err != nil {
+				t.Fatal(err)
+			}
+			overlay, err := parseStartConfigNode([]byte(tt.overlay))
+			if err != nil {
+				t.Fatal(err)
+			}
+			mergeConfigNodes(base.Content[0], overlay.Content[0], nil)
+
+			var got, want any
+			if err := base.Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				out, _ := yaml.Marshal(base)
+				t.Errorf("merged document:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package mageutil
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SyncStartConfigEnv enables syncing start-config.yml after a build. Set it to "prune" to also remove stale entries.
+const SyncStartConfigEnv = "SYNC_START_CONFIG"
+
+// ConfigSyncResult lists the changes made, or that would be made, by SyncStartConfig.
+type ConfigSyncResult struct {
+	AddedServices []string
+	AddedTools    []string
+	StaleServices []string
+	StaleTools    []string
+	Pruned        bool
+}
+
+func (r *ConfigSyncResult) changed() bool {
+	return len(r.AddedServices) > 0 || len(r.AddedTools) > 0 ||
+		(r.Pruned && (len(r.StaleServices) > 0 || len(r.StaleTools) > 0))
+}
+
+// ConfigCommand dispatches the `mage config <subcommand>` targets.
+func ConfigCommand(args []string) {
+	if len(args) == 0 {
+		PrintRed("Missing config subcommand, available: sync, show, validate")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "sync":
+		flags := newFlagSet("config sync")
+		prune := flags.Bool("prune", false, "remove entries of binaries that no longer exist")
+		if _, err := parseArgs(flags, args[1:]); err != nil {
+			PrintRed("Invalid config sync arguments: " + err.Error())
+			os.Exit(1)
+		}
+		if _, err := SyncStartConfig(*prune); err != nil {
+			PrintRed("Failed to sync start-config.yml: " + err.Error())
+			os.Exit(1)
+		}
+	case "show":
+		if _, err := parseArgs(newFlagSet("config show"), args[1:]); err != nil {
+			PrintRed("Invalid config show arguments: " + err.Error())
+			os.Exit(1)
+		}
+		if err := showConfig(); err != nil {
+			PrintRed(err.Error())
+			os.Exit(1)
+		}
+	case "validate":
+		flags := newFlagSet("config validate")
+		strict := flags.Bool("strict", false, "fail on warnings too")
+		if _, err := parseArgs(flags, args[1:]); err != nil {
+			PrintRed("Invalid config validate arguments: " + err.Error())
+			os.Exit(1)
+		}
+		if err := ValidateStartConfig(*strict); err != nil {
+			PrintRed(err.Error())
+			os.Exit(1)
+		}
+	default:
+		PrintRed(fmt.Sprintf("Unknown config subcommand %q, available: sync, show, validate", args[0]))
+		os.Exit(1)
+	}
+}
+
+// syncStartConfigAfterBuild syncs start-config.yml when enabled through SYNC_START_CONFIG.
+func syncStartConfigAfterBuild() {
+	mode := strings.ToLower(os.Getenv(SyncStartConfigEnv))
+	switch mode {
+	case "", "0", "false", "no":
+		return
+	}
+	if _, err := SyncStartConfig(mode == "prune"); err != nil {
+		PrintRed("Failed to sync start-config.yml: " + err.Error())
+	}
+}
+
+// discoverBinaries returns the names of the service and tool binaries found in the source directories.
+func discoverBinaries() (services, tools []string) {
+	discover := func(baseDir string) []string {
+		dirs, err := getSubDirectoriesBFS(baseDir)
+		if err != nil {
+			return nil
+		}
+		names := make([]string, 0, len(dirs))
+		seen := make(map[string]bool)
+		for _, dir := range dirs {
+			name := filepath.Base(dir)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	return discover(filepath.Join(Paths.Root, Paths.SrcDir)), discover(filepath.Join(Paths.Root, Paths.ToolsDir))
+}
+
+// SyncStartConfig adds binaries found in the source directories to start-config.yml and reports, or prunes,
+// entries whose source no longer exists. The YAML node tree is edited in place so comments and ordering survive.
+func SyncStartConfig(prune bool) (*ConfigSyncResult, error) {
+	configPath := startConfigPath()
+	services, tools := discoverBinaries()
+
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		createStartConfigYML(services, tools)
+		return &ConfigSyncResult{AddedServices: services, AddedTools: tools}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := parseStartConfigNode(data)
+	if err != nil {
+		return nil, err
+	}
+	root := doc.Content[0]
+
+	result := &ConfigSyncResult{Pruned: prune}
+	serviceNode := ensureChildNode(root, "serviceBinaries", yaml.MappingNode)
+	toolNode := ensureChildNode(root, "toolBinaries", yaml.SequenceNode)
+
+	existingServices := make(map[string]bool)
+	for i := 0; i+1 < len(serviceNode.Content); i += 2 {
+		existingServices[serviceNode.Content[i].Value] = true
+	}
+	existingTools := make(map[string]bool)
+	for _, n := range toolNode.Content {
+		existingTools[n.Value] = true
+	}
+
+	wantServices := make(map[string]bool)
+	for _, name := range services {
+		wantServices[name] = true
+		if !existingServices[name] {
+			result.AddedServices = append(result.AddedServices, name)
+			serviceNode.Content = append(serviceNode.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: "1"})
+		}
+	}
+	wantTools := make(map[string]bool)
+	for _, name := range tools {
+		wantTools[name] = true
+		if !existingTools[name] {
+			result.AddedTools = append(result.AddedTools, name)
+			toolNode.Content = append(toolNode.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name})
+		}
+	}
+
+	var keptServices []*yaml.Node
+	for i := 0; i+1 < len(serviceNode.Content); i += 2 {
+		key := serviceNode.Content[i]
+		if !wantServices[key.Value] {
+			result.StaleServices = append(result.StaleServices, key.Value)
+			if prune {
+				continue
+			}
+		}
+		keptServices = append(keptServices, key, serviceNode.Content[i+1])
+	}
+	var keptTools []*yaml.Node
+	for _, n := range toolNode.Content {
+		if !wantTools[n.Value] {
+			result.StaleTools = append(result.StaleTools, n.Value)
+			if prune {
+				continue
+			}
+		}
+		keptTools = append(keptTools, n)
+	}
+	serviceNode.Content = keptServices
+	toolNode.Content = keptTools
+
+	reportConfigSync(result)
+	if !result.changed() {
+		PrintGreen(fmt.Sprintf("%s is up to date.", configPath))
+		return result, nil
+	}
+
+	if err := writeStartConfigNode(configPath, doc); err != nil {
+		return nil, err
+	}
+	PrintGreen(fmt.Sprintf("%s synced successfully.", configPath))
+	return result, nil
+}
+
+// parseStartConfigNode parses start-config.yml into a node tree, which preserves comments and ordering when written back.
+func parseStartConfigNode(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("error unmarshalling YAML: %w", err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s must contain a mapping at the top level", StartConfigFile)
+	}
+	return &doc, nil
+}
+
+func writeStartConfigNode(path string, doc *yaml.Node) error {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return fmt.Errorf("error marshalling YAML: %w", err)
+	}
+	encoder.Close()
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// ensureChildNode returns the value node of key in a mapping, creating it, or replacing an empty value, with the given kind.
+func ensureChildNode(mapping *yaml.Node, key string, kind yaml.Kind) *yaml.Node {
+	tag := "!!map"
+	if kind == yaml.SequenceNode {
+		tag = "!!seq"
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != key {
+			continue
+		}
+		value := mapping.Content[i+1]
+		if value.Kind != kind {
+			// e.g. `toolBinaries:` without entries is parsed as null.
+			value.Kind, value.Tag, value.Value, value.Style = kind, tag, "", 0
+		}
+		return value
+	}
+	value := &yaml.Node{Kind: kind, Tag: tag}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	return value
+}
+
+func reportConfigSync(result *ConfigSyncResult) {
+	for _, name := range result.AddedServices {
+		PrintGreen(fmt.Sprintf("Added service %s with 1 instance", name))
+	}
+	for _, name := range result.AddedTools {
+		PrintGreen(fmt.Sprintf("Added tool %s", name))
+	}
+	verb := "Stale"
+	if result.Pruned {
+		verb = "Pruned"
+	}
+	for _, name := range result.StaleServices {
+		PrintYellow(fmt.Sprintf("%s service %s, no source found under %s", verb, name, Paths.SrcDir))
+	}
+	for _, name := range result.StaleTools {
+		PrintYellow(fmt.Sprintf("%s tool %s, no source found under %s", verb, name, Paths.ToolsDir))
+	}
+	if !result.Pruned && (len(result.StaleServices) > 0 || len(result.StaleTools) > 0) {
+		PrintYellow("Run `mage config sync --prune` to remove stale entries.")
+	}
+}
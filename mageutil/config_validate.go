@@ -0,0 +1,426 @@
+package mageutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configIssue is an error or warning about start-config.yml, positioned in the file it was found in.
+type configIssue struct {
+	file    string
+	line    int // 0 when unknown
+	column  int // 0 when unknown
+	message string
+}
+
+func (i configIssue) String() string {
+	switch {
+	case i.line == 0:
+		return fmt.Sprintf("%s: %s", i.file, i.message)
+	case i.column == 0:
+		return fmt.Sprintf("%s:%d: %s", i.file, i.line, i.message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", i.file, i.line, i.column, i.message)
+}
+
+// configFile is one of the files the configuration was merged from, base first.
+type configFile struct {
+	path string
+	root *yaml.Node // Top-level mapping
+}
+
+// configReport collects the issues found while loading start-config.yml and the overlay of the environment.
+type configReport struct {
+	files    []configFile
+	errors   []configIssue
+	warnings []configIssue
+}
+
+func (r *configReport) failed() bool {
+	return len(r.errors) > 0
+}
+
+func newConfigIssue(file string, node *yaml.Node, format string, args ...any) configIssue {
+	issue := configIssue{file: file, message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		issue.line, issue.column = node.Line, node.Column
+	}
+	return issue
+}
+
+// errorAt records an error at the value of path in the last file that sets it, e.g. the overlay.
+func (r *configReport) errorAt(path []string, format string, args ...any) {
+	file, node := r.lookup(path)
+	r.errors = append(r.errors, newConfigIssue(file, node, format, args...))
+}
+
+// warnAt records a warning at the value of path in the last file that sets it.
+func (r *configReport) warnAt(path []string, format string, args ...any) {
+	file, node := r.lookup(path)
+	r.warnings = append(r.warnings, newConfigIssue(file, node, format, args...))
+}
+
+// lookup returns the file and node of the value at path, a sequence item is addressed by its index. When no file
+// sets the full path, the closest parent value is returned.
+func (r *configReport) lookup(path []string) (string, *yaml.Node) {
+	bestFile, bestDepth := "", -1
+	var best *yaml.Node
+	for i := len(r.files) - 1; i >= 0; i-- {
+		node, depth := configNodeAt(r.files[i].root, path)
+		if depth > bestDepth {
+			bestFile, best, bestDepth = r.files[i].path, node, depth
+		}
+		if depth == len(path) {
+			break
+		}
+	}
+	if bestFile == "" {
+		bestFile = startConfigPath()
+	}
+	return bestFile, best
+}
+
+// configNodeAt follows path from node and returns the deepest node found with the number of path elements matched.
+func configNodeAt(node *yaml.Node, path []string) (*yaml.Node, int) {
+	for depth, key := range path {
+		var next *yaml.Node
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+		if next == nil {
+			return node, depth
+		}
+		node = next
+	}
+	return node, len(path)
+}
+
+// print prints the warnings and errors, one per line with their position, in file order.
+func (r *configReport) print() {
+	fileIndex := make(map[string]int)
+	for i, file := range r.files {
+		fileIndex[file.path] = i
+	}
+	for _, issues := range [][]configIssue{r.warnings, r.errors} {
+		sort.SliceStable(issues, func(i, j int) bool {
+			a, b := issues[i], issues[j]
+			if a.file != b.file {
+				return fileIndex[a.file] < fileIndex[b.file]
+			}
+			if a.line != b.line {
+				return a.line < b.line
+			}
+			return a.column < b.column
+		})
+	}
+	for _, issue := range r.warnings {
+		PrintYellow("warning: " + issue.String())
+	}
+	for _, issue := range r.errors {
+		PrintRedNoTimeStamp(issue.String())
+	}
+}
+
+// loadStartConfig loads the effective configuration like InitForSSC and validates it: unknown keys and values of
+// the wrong type in each file, then the services and tools of the merged configuration. The configuration is only
+// returned when there are no errors.
+func loadStartConfig() (*Config, *configReport, error) {
+	doc, sources, err := loadStartConfigNode()
+	if err != nil {
+		return nil, nil, err
+	}
+	report := &configReport{}
+	for _, path := range sources {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileDoc, err := parseStartConfigNode(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		root := fileDoc.Content[0]
+		report.files = append(report.files, configFile{path: path, root: root})
+		checkConfigKeys(report, path, root, reflect.TypeOf(Config{}), "")
+		var config Config
+		if err := fileDoc.Decode(&config); err != nil {
+			report.errors = append(report.errors, decodeIssues(path, err)...)
+		}
+	}
+	if report.failed() {
+		return nil, report, nil
+	}
+
+	var config Config
+	if err := doc.Decode(&config); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling YAML: %v", err)
+	}
+	checkConfigValues(report, &config)
+	if report.failed() {
+		return nil, report, nil
+	}
+	return &config, report, nil
+}
+
+// checkConfigKeys reports the keys of node that don't match a field of t, following the yaml tags of the fields.
+func checkConfigKeys(report *configReport, file string, node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := yamlFields(t)
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if key.Value == "<<" {
+					continue // Merge key, the merged mapping is checked where it is defined
+				}
+				field, ok := fields[key.Value]
+				if !ok {
+					message := fmt.Sprintf("unknown key %q", key.Value)
+					if path != "" {
+						message += " in " + path
+					}
+					if suggestion := closestKey(key.Value, fields); suggestion != "" {
+						message += fmt.Sprintf(", did you mean %q?", suggestion)
+					}
+					report.errors = append(report.errors, newConfigIssue(file, key, "%s", message))
+					continue
+				}
+				checkConfigKeys(report, file, value, field, joinConfigPath(path, key.Value))
+			}
+		case reflect.Map:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				checkConfigKeys(report, file, node.Content[i+1], t.Elem(), joinConfigPath(path, node.Content[i].Value))
+			}
+		}
+	case yaml.SequenceNode:
+		if t.Kind() == reflect.Slice {
+			for i, item := range node.Content {
+				checkConfigKeys(report, file, item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// yamlFields returns the types of the fields of a struct by their yaml key, which is the lowercased field name
+// when there is no tag.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for key, typ := range yamlFields(field.Type) {
+				fields[key] = typ
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// closestKey returns the known key closest to a misspelled one, empty when none is close enough.
+func closestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", len(key)/3+1
+	if bestDistance < 3 {
+		bestDistance = 3
+	}
+	for candidate := range fields {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(candidate)); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+var yamlLinePattern = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// decodeIssues turns a decoding error of file into issues, with the line yaml.v3 reports for each of them.
+func decodeIssues(file string, err error) []configIssue {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+	var issues []configIssue
+	for _, message := range messages {
+		issue := configIssue{file: file, message: strings.TrimPrefix(message, "yaml: ")}
+		if m := yamlLinePattern.FindStringSubmatch(issue.message); m != nil {
+			issue.line, _ = strconv.Atoi(m[1])
+			issue.message = m[2]
+		}
+		issues = append(issues, issue)
+	}
+	return issues
+}
+
+// checkConfigValues validates the services and tools of the merged configuration.
+func checkConfigValues(report *configReport, config *Config) {
+	names := make([]string, 0, len(config.ServiceBinaries))
+	for name := range config.ServiceBinaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cfg := config.ServiceBinaries[name]
+		if cfg == nil {
+			continue
+		}
+		path := []string{"serviceBinaries", name}
+		if cfg.Count < 0 {
+			report.errorAt(append(path, "count"), "service %s: instance count must not be negative, got %d", name, cfg.Count)
+		}
+		if err := cfg.validate(); err != nil {
+			report.errorAt(path, "service %s: %v", name, err)
+		}
+		for i, dep := range cfg.DependsOn {
+			if _, ok := config.ServiceBinaries[dep]; !ok {
+				report.errorAt(append(path, "dependsOn", strconv.Itoa(i)), "service %s depends on %s, which is not in serviceBinaries", name, dep)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, tool := range config.ToolBinaries {
+		path := []string{"toolBinaries", strconv.Itoa(i)}
+		switch {
+		case strings.TrimSpace(tool) == "":
+			report.errorAt(path, "empty tool name")
+		case seen[tool]:
+			report.errorAt(path, "tool %s is listed twice", tool)
+		}
+		seen[tool] = true
+	}
+}
+
+// checkConfigDependencies reports a dependency cycle at the dependsOn entry that closes it, unknown dependencies
+// are reported by checkConfigValues. It needs the configuration applied.
+func checkConfigDependencies(report *configReport) {
+	if _, err := serviceWaves(configuredServices()); err == nil {
+		return
+	}
+	services := make(map[string]bool)
+	for _, service := range configuredServices() {
+		services[service] = true
+	}
+	cycle := findDependencyCycle(services)
+	names := make([]string, len(cycle))
+	for i, service := range cycle {
+		names[i] = strings.TrimSuffix(service, ".exe")
+	}
+	last := len(cycle) - 2
+	index := slices.Index(serviceDependencies(cycle[last]), cycle[last+1])
+	report.errorAt([]string{"serviceBinaries", names[last], "dependsOn", strconv.Itoa(index)}, "dependency cycle: %s", strings.Join(names, " -> "))
+}
+
+// checkConfigBinaries warns about configured services and tools that have no built binary, and reports the ones
+// that also have no source directory as errors since they can never be started. It needs the configuration applied.
+func checkConfigBinaries(report *configReport) {
+	sourceServices, sourceTools := discoverBinaries()
+	check := func(kind, section string, names []string, sources []string, binaryPath func(string) string, srcDir string) {
+		for _, binary := range names {
+			name := strings.TrimSuffix(binary, ".exe")
+			if fileExists(binaryPath(binary)) {
+				continue
+			}
+			path := []string{section, name}
+			if section == "toolBinaries" {
+				path = []string{section, strconv.Itoa(slices.Index(names, binary))}
+			}
+			if slices.Contains(sources, name) {
+				report.warnAt(path, "%s %s has no built binary at %s, run `mage build`", kind, name, binaryPath(binary))
+			} else {
+				report.errorAt(path, "%s %s has no source directory under %s and no built binary at %s", kind, name, srcDir, binaryPath(binary))
+			}
+		}
+	}
+	check("service", "serviceBinaries", configuredServices(), sourceServices, GetBinFullPath, Paths.SrcDir)
+	check("tool", "toolBinaries", toolBinaries, sourceTools, GetBinToolsFullPath, Paths.ToolsDir)
+}
+
+// ValidateStartConfig validates start-config.yml, merged with the overlay of the selected environment, and prints
+// the issues found. Warnings fail the validation too when strict.
+func ValidateStartConfig(strict bool) error {
+	config, report, err := loadStartConfig()
+	if err != nil {
+		return err
+	}
+	if config != nil {
+		applyStartConfig(config)
+		checkConfigDependencies(report)
+		checkConfigBinaries(report)
+	}
+	report.print()
+
+	files := make([]string, len(report.files))
+	for i, file := range report.files {
+		files[i] = file.path
+	}
+	if report.failed() || (strict && len(report.warnings) > 0) {
+		return fmt.Errorf("%s is invalid: %d errors, %d warnings", strings.Join(files, " + "), len(report.errors), len(report.warnings))
+	}
+	PrintGreen(fmt.Sprintf("%s is valid, %d warnings", strings.Join(files, " + "), len(report.warnings)))
+	return nil
+}
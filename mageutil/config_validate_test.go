@@ -0,0 +1,190 @@
+package mageutil
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseTestConfig parses a start-config.yml document and returns its top-level mapping.
+func parseTestConfig(t *testing.T, text string) *yaml.Node {
+	t.Helper()
+	doc, err := parseStartConfigNode([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc.Content[0]
+}
+
+func issueStrings(issues []configIssue) []string {
+	var out []string
+	for _, issue := range issues {
+		out = append(out, issue.String())
+	}
+	return out
+}
+
+func TestCheckConfigKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "known keys",
+			config: "serviceBinaries:\n  api:\n    count: 2\n    probes:\n      readiness: {tcp: \"127.0.0.1:10002\"}\n  rpc: 1\ntoolBinaries: [check]\nlogs: {maxSize: 10}\n",
+		},
+		{
+			name:   "top-level typo",
+			config: "serviceBinaris: {}\n",
+			want:   []string{`f.yml:1:1: unknown key "serviceBinaris", did you mean "serviceBinaries"?`},
+		},
+		{
+			name:   "service typo",
+			config: "serviceBinaries:\n  api:\n    cuont: 2\n",
+			want:   []string{`f.yml:3:5: unknown key "cuont" in serviceBinaries.api, did you mean "count"?`},
+		},
+		{
+			name:   "nested typo",
+			config: "serviceBinaries:\n  api:\n    probes:\n      readiness:\n        htp: {url: x}\n",
+			want:   []string{`f.yml:5:9: unknown key "htp" in serviceBinaries.api.probes.readiness, did you mean "http"?`},
+		},
+		{
+			name:   "no close key",
+			config: "zzzzzzzz: 1\n",
+			want:   []string{`f.yml:1:1: unknown key "zzzzzzzz"`},
+		},
+		{
+			name:   "several unknown keys",
+			config: "logs:\n  maxsize: 10\n  compres: true\n",
+			want: []string{
+				`f.yml:2:3: unknown key "maxsize" in logs, did you mean "maxSize"?`,
+				`f.yml:3:3: unknown key "compres" in logs, did you mean "compress"?`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &configReport{}
+			checkConfigKeys(report, "f.yml", parseTestConfig(t, tt.config), reflect.TypeOf(Config{}), "")
+			if got := issueStrings(report.errors); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClosestKey(t *testing.T) {
+	fields := yamlFields(reflect.TypeOf(ServiceConfig{}))
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"cont", "count"},
+		{"COUNT", "count"},
+		{"dependson", "dependsOn"},
+		{"argTemplates", "argTemplate"},
+		{"workdir", "workDir"},
+		{"restrt", "restart"},
+		{"replicas", ""},
+		{"x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := closestKey(tt.key, fields); got != tt.want {
+				t.Errorf("closestKey(%q) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeIssues(t *testing.T) {
+	decode := func(text string) error {
+		var config Config
+		return yaml.Unmarshal([]byte(text), &config)
+	}
+	tests := []struct {
+		name string
+		err  error
+		want []string
+	}{
+		{
+			name: "type error",
+			err:  decode("serviceBinaries:\n  api: many\n"),
+			want: []string{"f.yml:2: cannot unmarshal !!str `many` into int"},
+		},
+		{
+			name: "invalid limit",
+			err:  decode("serviceBinaries:\n  api:\n    limits:\n      memory: lots\n"),
+			want: []string{`f.yml:4: invalid limit "lots", expected a number, a size such as 512M or unlimited`},
+		},
+		{
+			name: "every error of the file",
+			err:  decode("maxFileDescriptors: many\nverifyBinaries: maybe\n"),
+			want: []string{
+				"f.yml:1: cannot unmarshal !!str `many` into int",
+				"f.yml:2: cannot unmarshal !!str `maybe` into bool",
+			},
+		},
+		{
+			name: "syntax error",
+			err:  decode("serviceBinaries: {}\nlogs: a: b\n"),
+			want: []string{"f.yml:2: mapping values are not allowed in this context"},
+		},
+		{
+			name: "no position",
+			err:  errors.New("something failed"),
+			want: []string{"f.yml: something failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err == nil {
+				t.Fatal("decoding succeeded")
+			}
+			if got := issueStrings(decodeIssues("f.yml", tt.err)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decodeIssues() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckConfigDependencies(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{
+			name:   "no cycle",
+			config: "serviceBinaries:\n  api:\n    dependsOn: [rpc]\n  rpc: 1\n",
+		},
+		{
+			name:   "cycle",
+			config: "serviceBinaries:\n  api:\n    dependsOn: [rpc]\n  rpc:\n    dependsOn: [push, api]\n  push: 1\n",
+			want:   []string{"f.yml:5:23: dependency cycle: api -> rpc -> api"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := parseTestConfig(t, tt.config)
+			var config Config
+			if err := root.Decode(&config); err != nil {
+				t.Fatal(err)
+			}
+			deps := make(map[string][]string)
+			for service, cfg := range config.ServiceBinaries {
+				deps[service] = cfg.DependsOn
+			}
+			useServices(t, deps)
+
+			report := &configReport{files: []configFile{{path: "f.yml", root: root}}}
+			checkConfigDependencies(report)
+			if got := issueStrings(report.errors); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("issues = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
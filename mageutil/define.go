@@ -4,46 +4,87 @@ import (
 	"fmt"
 	"os"
 	"runtime"
-
-	"gopkg.in/yaml.v3"
 )
 
 const (
 	StartConfigFile = "start-config.yml"
+	// StartConfigEnv overrides the location of start-config.yml, e.g. for an installed tree.
+	StartConfigEnv = "GOMAKE_START_CONFIG"
 )
 
 var (
 	serviceBinaries    map[string]int
+	serviceConfigs     map[string]*ServiceConfig
 	toolBinaries       []string
 	MaxFileDescriptors int
+	verifyBinaries     bool
+	verifyPublicKey    string
 )
 
 type Config struct {
-	ServiceBinaries    map[string]int `yaml:"serviceBinaries"`
-	ToolBinaries       []string       `yaml:"toolBinaries"`
-	MaxFileDescriptors int            `yaml:"maxFileDescriptors"`
+	ServiceBinaries    map[string]*ServiceConfig `yaml:"serviceBinaries"`
+	ToolBinaries       []string                  `yaml:"toolBinaries"`
+	MaxFileDescriptors int                       `yaml:"maxFileDescriptors"`
+	VerifyBinaries     bool                      `yaml:"verifyBinaries"`  // Refuse to start binaries that don't match the build manifest
+	VerifyPublicKey    string                    `yaml:"verifyPublicKey"` // Optional ed25519 public key, requires a signed manifest
+	Logs               LogConfig                 `yaml:"logs"`            // Log rotation of services without their own logs section and of tools
+	Cgroup             string                    `yaml:"cgroup"`          // cgroup v2 subtree for memory and cpu limits, default gomake
+	Paths              PathsConfig               `yaml:"paths"`
+	Package            PackageConfig             `yaml:"package"`
+}
+
+// PathsConfig overrides the directories used to start services, written by `mage install` for the installed tree.
+type PathsConfig struct {
+	Bin    string `yaml:"bin"`
+	Tools  string `yaml:"tools"`
+	Config string `yaml:"config"`
+	Logs   string `yaml:"logs"`
+	Tmp    string `yaml:"tmp"`
+}
+
+// startConfigPath returns the path of start-config.yml, honoring GOMAKE_START_CONFIG.
+func startConfigPath() string {
+	if path := os.Getenv(StartConfigEnv); path != "" {
+		return path
+	}
+	return StartConfigFile
 }
 
+// InitForSSC loads start-config.yml, merged with the overlay of the environment selected with --env or GOMAKE_ENV,
+// and exits when it is invalid.
 func InitForSSC() {
-	yamlFile, err := os.ReadFile(StartConfigFile)
+	config, report, err := loadStartConfig()
 	if err != nil {
-		fmt.Printf("error reading YAML file: %v", err)
+		fmt.Printf("%v", err)
 		os.Exit(1)
 	}
-
-	var config Config
-	err = yaml.Unmarshal(yamlFile, &config)
-	if err != nil {
-		fmt.Printf("error unmarshalling YAML: %v", err)
+	if config != nil {
+		applyStartConfig(config)
+		checkConfigDependencies(report)
+	}
+	if report.failed() {
+		PrintRed("Invalid configuration:")
+		report.print()
 		os.Exit(1)
 	}
+}
 
+// applyStartConfig sets the services, tools and settings of a loaded configuration.
+func applyStartConfig(config *Config) {
 	adjustedBinaries := make(map[string]int)
-	for binary, count := range config.ServiceBinaries {
+	adjustedConfigs := make(map[string]*ServiceConfig)
+	for binary, serviceConfig := range config.ServiceBinaries {
+		if serviceConfig == nil {
+			serviceConfig = &ServiceConfig{}
+		}
 		if runtime.GOOS == "windows" {
 			binary += ".exe"
+			for i, dep := range serviceConfig.DependsOn {
+				serviceConfig.DependsOn[i] = dep + ".exe"
+			}
 		}
-		adjustedBinaries[binary] = count
+		adjustedBinaries[binary] = serviceConfig.Count
+		adjustedConfigs[binary] = serviceConfig
 	}
 
 	var adjustedToolsBinaries []string
@@ -54,6 +95,13 @@ func InitForSSC() {
 		adjustedToolsBinaries = append(adjustedToolsBinaries, tool)
 	}
 	serviceBinaries = adjustedBinaries
+	serviceConfigs = adjustedConfigs
 	toolBinaries = adjustedToolsBinaries
 	MaxFileDescriptors = config.MaxFileDescriptors
+	verifyBinaries = config.VerifyBinaries || config.VerifyPublicKey != ""
+	verifyPublicKey = config.VerifyPublicKey
+	defaultLogConfig = config.Logs
+	cgroupRoot = config.Cgroup
+	Paths.applyOverrides(config.Paths)
+	packageConfig = config.Package
 }
@@ -0,0 +1,167 @@
+package mageutil
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// waveSettleTime is how long instances without a readiness probe must stay up before the next wave is started.
+const waveSettleTime = time.Second
+
+// serviceDependencies returns the configured dependencies of a service.
+func serviceDependencies(binary string) []string {
+	if cfg, ok := serviceConfigs[binary]; ok && cfg != nil {
+		return cfg.DependsOn
+	}
+	return nil
+}
+
+// serviceWaves groups services into start waves, every service is in a later wave than the services it depends on.
+// Dependencies outside the given services are ignored, so a subset can be started on its own.
+func serviceWaves(services []string) ([][]string, error) {
+	remaining := make(map[string]bool)
+	for _, service := range services {
+		remaining[service] = true
+	}
+
+	var waves [][]string
+	for len(remaining) > 0 {
+		var wave []string
+		for service := range remaining {
+			ready := true
+			for _, dep := range serviceDependencies(service) {
+				if remaining[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, service)
+			}
+		}
+		if len(wave) == 0 {
+			return nil, fmt.Errorf("dependency cycle: %s", strings.Join(findDependencyCycle(remaining), " -> "))
+		}
+		slices.Sort(wave)
+		for _, service := range wave {
+			delete(remaining, service)
+		}
+		waves = append(waves, wave)
+	}
+	return waves, nil
+}
+
+// findDependencyCycle returns a cycle among the given services, which are known to contain one, e.g. [a b a].
+func findDependencyCycle(services map[string]bool) []string {
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	slices.Sort(names)
+
+	visited := make(map[string]bool)
+	var path []string
+	var visit func(service string) []string
+	visit = func(service string) []string {
+		if i := slices.Index(path, service); i >= 0 {
+			return append(slices.Clone(path[i:]), service)
+		}
+		if visited[service] {
+			return nil
+		}
+		visited[service] = true
+		path = append(path, service)
+		for _, dep := range serviceDependencies(service) {
+			if services[dep] {
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return nil
+	}
+	for _, service := range names {
+		if cycle := visit(service); cycle != nil {
+			return cycle
+		}
+	}
+	return names
+}
+
+// stopServiceProcessesInOrder stops the services in reverse start order, dependents before their dependencies.
+func stopServiceProcessesInOrder(procs map[string][]*process.Process) []string {
+	services := make([]string, 0, len(procs))
+	for service := range procs {
+		services = append(services, service)
+	}
+	var killed []string
+	for _, wave := range stopWaves(services) {
+		stopping := make(map[string][]*process.Process)
+		for _, service := range wave {
+			stopping[service] = procs[service]
+		}
+		killed = append(killed, stopServiceProcesses(stopping)...)
+	}
+	return killed
+}
+
+// stopWaves groups the running services into the waves they are stopped in, the last start wave first. The waves
+// are computed on all configured services, so a dependent is stopped before its dependency even when a service
+// between them is not running.
+func stopWaves(running []string) [][]string {
+	services := configuredServices()
+	for _, service := range running {
+		if !slices.Contains(services, service) {
+			services = append(services, service)
+		}
+	}
+	waves, err := serviceWaves(services)
+	if err != nil {
+		wave := slices.Clone(running)
+		slices.Sort(wave)
+		return [][]string{wave}
+	}
+
+	var stopping [][]string
+	for i := len(waves) - 1; i >= 0; i-- {
+		var wave []string
+		for _, service := range waves[i] {
+			if slices.Contains(running, service) {
+				wave = append(wave, service)
+			}
+		}
+		if len(wave) > 0 {
+			stopping = append(stopping, wave)
+		}
+	}
+	return stopping
+}
+
+// Graph prints the service dependency graph in DOT format, e.g. `mage graph | dot -Tsvg > graph.svg`.
+func Graph() {
+	InitForSSC()
+	fmt.Print(dependencyGraphDOT())
+}
+
+func dependencyGraphDOT() string {
+	var b strings.Builder
+	b.WriteString("digraph services {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box];\n")
+	for _, service := range configuredServices() {
+		name := strings.TrimSuffix(service, ".exe")
+		fmt.Fprintf(&b, "  %q [label=%q];\n", name, fmt.Sprintf("%s x%d", name, serviceBinaries[service]))
+	}
+	for _, service := range configuredServices() {
+		for _, dep := range serviceDependencies(service) {
+			fmt.Fprintf(&b, "  %q -> %q;\n", strings.TrimSuffix(service, ".exe"), strings.TrimSuffix(dep, ".exe"))
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
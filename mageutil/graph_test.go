@@ -0,0 +1,144 @@
+package mageutil
+
+import (
+	"reflect"
+	"testing"
+)
+
+// useServices replaces the configured services for the duration of a test, deps maps every service to the
+// services it depends on.
+func useServices(t *testing.T, deps map[string][]string) {
+	t.Helper()
+	binaries, configs := serviceBinaries, serviceConfigs
+	t.Cleanup(func() { serviceBinaries, serviceConfigs = binaries, configs })
+
+	serviceBinaries = make(map[string]int)
+	serviceConfigs = make(map[string]*ServiceConfig)
+	for service, dependsOn := range deps {
+		serviceBinaries[service] = 1
+		serviceConfigs[service] = &ServiceConfig{Count: 1, DependsOn: dependsOn}
+	}
+}
+
+func TestServiceWaves(t *testing.T) {
+	tests := []struct {
+		name     string
+		deps     map[string][]string
+		services []string // Configured services when nil
+		want     [][]string
+		err      string
+	}{
+		{
+			name: "independent",
+			deps: map[string][]string{"a": nil, "b": nil},
+			want: [][]string{{"a", "b"}},
+		},
+		{
+			name: "chain",
+			deps: map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}},
+			want: [][]string{{"a"}, {"b"}, {"c"}},
+		},
+		{
+			name: "diamond",
+			deps: map[string][]string{"a": nil, "b": {"a"}, "c": {"a"}, "d": {"b", "c"}},
+			want: [][]string{{"a"}, {"b", "c"}, {"d"}},
+		},
+		{
+			name:     "dependency outside the subset",
+			deps:     map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}},
+			services: []string{"c", "b"},
+			want:     [][]string{{"b"}, {"c"}},
+		},
+		{
+			name: "cycle",
+			deps: map[string][]string{"a": {"b"}, "b": {"a"}},
+			err:  "dependency cycle: a -> b -> a",
+		},
+		{
+			name: "self dependency",
+			deps: map[string][]string{"a": {"a"}, "b": nil},
+			err:  "dependency cycle: a -> a",
+		},
+		{
+			name: "cycle behind a dependent",
+			deps: map[string][]string{"a": {"c"}, "b": nil, "c": {"d"}, "d": {"c"}},
+			err:  "dependency cycle: c -> d -> c",
+		},
+		{
+			name:     "cycle outside the subset",
+			deps:     map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"a"}},
+			services: []string{"c"},
+			want:     [][]string{{"c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServices(t, tt.deps)
+			services := tt.services
+			if services == nil {
+				services = configuredServices()
+			}
+			waves, err := serviceWaves(services)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("serviceWaves() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("serviceWaves() error = %v", err)
+			}
+			if !reflect.DeepEqual(waves, tt.want) {
+				t.Errorf("serviceWaves() = %v, want %v", waves, tt.want)
+			}
+		})
+	}
+}
+
+func TestStopWaves(t *testing.T) {
+	tests := []struct {
+		name    string
+		deps    map[string][]string
+		running []string
+		want    [][]string
+	}{
+		{
+			name:    "chain",
+			deps:    map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}},
+			running: []string{"a", "b", "c"},
+			want:    [][]string{{"c"}, {"b"}, {"a"}},
+		},
+		{
+			name:    "service between them not running",
+			deps:    map[string][]string{"a": nil, "b": {"a"}, "c": {"b"}},
+			running: []string{"c", "a"},
+			want:    [][]string{{"c"}, {"a"}},
+		},
+		{
+			name:    "independent",
+			deps:    map[string][]string{"a": nil, "b": nil, "c": {"a"}},
+			running: []string{"b", "a"},
+			want:    [][]string{{"a", "b"}},
+		},
+		{
+			name:    "not configured",
+			deps:    map[string][]string{"a": nil, "b": {"a"}},
+			running: []string{"a", "b", "x"},
+			want:    [][]string{{"b"}, {"a", "x"}},
+		},
+		{
+			name:    "cycle",
+			deps:    map[string][]string{"a": {"b"}, "b": {"a"}, "c": nil},
+			running: []string{"c", "a"},
+			want:    [][]string{{"a", "c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useServices(t, tt.deps)
+			if got := stopWaves(tt.running); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stopWaves(%v) = %v, want %v", tt.running, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package mageutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultInstallPrefix = "/usr/local"
+	installRecordFile    = "installed.json"
+)
+
+// Installed tree layout, relative to the prefix.
+var (
+	installBinDir    = "bin"
+	installToolsDir  = filepath.Join("bin", ToolsDir)
+	installEtcDir    = "etc"
+	installConfigDir = filepath.Join("etc", ConfigDir)
+	installLogDir    = filepath.Join("var", "log")
+	installTmpDir    = filepath.Join("var", TmpDir)
+	installRecordDir = filepath.Join("var", "lib", "gomake")
+)
+
+// InstallRecord lists everything written by `mage install` so `mage uninstall` can remove exactly that.
+type InstallRecord struct {
+	Prefix      string    `json:"prefix"`
+	InstalledAt time.Time `json:"installedAt"`
+	Files       []string  `json:"files"`
+	Dirs        []string  `json:"dirs"` // Directories created by install, in creation order
+}
+
+type installer struct {
+	root   string // DESTDIR joined with the prefix
+	record *InstallRecord
+}
+
+// Install copies the host binaries, tools, config directory and start-config.yml into prefix and records the installed files.
+func Install(args []string) {
+	prefix, destDir, err := parseInstallArgs("install", args)
+	if err != nil {
+		PrintRed("Invalid install arguments: " + err.Error())
+		os.Exit(1)
+	}
+	if err := InstallTo(prefix, destDir); err != nil {
+		PrintRed("Install failed: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+// Uninstall removes the files recorded by a previous install into prefix.
+func Uninstall(args []string) {
+	prefix, destDir, err := parseInstallArgs("uninstall", args)
+	if err != nil {
+		PrintRed("Invalid uninstall arguments: " + err.Error())
+		os.Exit(1)
+	}
+	if err := UninstallFrom(prefix, destDir); err != nil {
+		PrintRed("Uninstall failed: " + err.Error())
+		os.Exit(1)
+	}
+}
+
+func parseInstallArgs(name string, args []string) (string, string, error) {
+	flags := newFlagSet(name)
+	prefix := flags.String("prefix", DefaultInstallPrefix, "installation prefix")
+	destDir := flags.String("destdir", os.Getenv("DESTDIR"), "staging directory prepended to the prefix")
+	rest, err := parseArgs(flags, args)
+	if err != nil {
+		return "", "", err
+	}
+	if len(rest) > 0 {
+		return "", "", fmt.Errorf("unexpected arguments: %v", rest)
+	}
+	if !filepath.IsAbs(*prefix) {
+		return "", "", fmt.Errorf("prefix must be an absolute path: %s", *prefix)
+	}
+	return filepath.Clean(*prefix), *destDir, nil
+}
+
+func installRoot(prefix, destDir string) string {
+	if destDir == "" {
+		return prefix
+	}
+	return filepath.Join(destDir, prefix)
+}
+
+// InstallTo installs into prefix, staged below destDir when it is not empty.
+func InstallTo(prefix, destDir string) error {
+	services, err := listRegularFiles(Paths.OutputHostBin)
+	if err != nil {
+		return err
+	}
+	tools, err := listRegularFiles(Paths.OutputHostBinTools)
+	if err != nil {
+		return err
+	}
+	if countBinaries(services) == 0 && countBinaries(tools) == 0 {
+		return fmt.Errorf("no binaries found in %s or %s, please build first", Paths.OutputHostBin, Paths.OutputHostBinTools)
+	}
+
+	inst := &installer{
+		root:   installRoot(prefix, destDir),
+		record: &InstallRecord{Prefix: prefix, InstalledAt: time.Now()},
+	}
+	// A previous install created the directories that already exist, keep them in the record so uninstall still
+	// removes them.
+	previous, err := readInstallRecord(inst.root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	PrintBlue(fmt.Sprintf("Installing to %s", inst.root))
+
+	for _, name := range services {
+		if err := inst.copyFile(filepath.Join(Paths.OutputHostBin, name), filepath.Join(installBinDir, name)); err != nil {
+			return err
+		}
+	}
+	for _, name := range tools {
+		if err := inst.copyFile(filepath.Join(Paths.OutputHostBinTools, name), filepath.Join(installToolsDir, name)); err != nil {
+			return err
+		}
+	}
+
+	if err := inst.mkdir(installConfigDir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(Paths.Config); err == nil {
+		err = filepath.WalkDir(Paths.Config, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(Paths.Config, path)
+			if err != nil || rel == "." {
+				return err
+			}
+			if d.IsDir() {
+				return inst.mkdir(filepath.Join(installConfigDir, rel))
+			}
+			return inst.copyFile(path, filepath.Join(installConfigDir, rel))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to install config directory: %w", err)
+		}
+	}
+
+	if err := inst.mkdir(installLogDir); err != nil {
+		return err
+	}
+	if err := inst.mkdir(installTmpDir); err != nil {
+		return err
+	}
+
+	startConfig, err := installedStartConfig(prefix)
+	if err != nil {
+		return err
+	}
+	if err := inst.writeFile(filepath.Join(installEtcDir, StartConfigFile), startConfig, 0644); err != nil {
+		return err
+	}
+
+	if err := inst.mkdir(installRecordDir); err != nil {
+		return err
+	}
+	recordRel := filepath.Join(installRecordDir, installRecordFile)
+	inst.record.Files = append(inst.record.Files, recordRel)
+	if previous != nil {
+		inst.record.merge(previous)
+	}
+	data, err := json.MarshalIndent(inst.record, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(inst.root, recordRel), data, 0644); err != nil {
+		return fmt.Errorf("failed to write install record: %w", err)
+	}
+
+	PrintGreen(fmt.Sprintf("Installed %d services and %d tools to %s", countBinaries(services), countBinaries(tools), inst.root))
+	PrintGreen(fmt.Sprintf("Start them with `%s=%s mage start`", StartConfigEnv, filepath.Join(prefix, installEtcDir, StartConfigFile)))
+	return nil
+}
+
+// installedStartConfig returns start-config.yml, merged with the overlay of the selected environment, with its
+// paths pointing into the installed tree.
+func installedStartConfig(prefix string) ([]byte, error) {
+	var doc *yaml.Node
+	if _, err := os.Stat(startConfigPath()); os.IsNotExist(err) {
+		if doc, err = parseStartConfigNode(nil); err != nil {
+			return nil, err
+		}
+	} else if doc, _, err = loadStartConfigNode(); err != nil {
+		return nil, err
+	}
+
+	paths := ensureChildNode(doc.Content[0], "paths", yaml.MappingNode)
+	paths.Content = nil
+	for _, kv := range [][2]string{
+		{"bin", filepath.Join(prefix, installBinDir)},
+		{"tools", filepath.Join(prefix, installToolsDir)},
+		{"config", filepath.Join(prefix, installConfigDir)},
+		{"logs", filepath.Join(prefix, installLogDir)},
+		{"tmp", filepath.Join(prefix, installTmpDir)},
+	} {
+		paths.Content = append(paths.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[0]},
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: kv[1]})
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, fmt.Errorf("error marshalling YAML: %w", err)
+	}
+	encoder.Close()
+	return buf.Bytes(), nil
+}
+
+// mkdir creates rel and its parents below the install root, recording the directories it created.
+func (i *installer) mkdir(rel string) error {
+	var missing []string
+	for dir := rel; dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(i.root, dir)); err == nil {
+			break
+		}
+		missing = append(missing, dir)
+	}
+	if err := os.MkdirAll(filepath.Join(i.root, rel), 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filepath.Join(i.root, rel), err)
+	}
+	for j := len(missing) - 1; j >= 0; j-- {
+		i.record.Dirs = append(i.record.Dirs, missing[j])
+	}
+	return nil
+}
+
+func (i *installer) copyFile(src, rel string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return i.writeFile(rel, data, info.Mode().Perm())
+}
+
+func (i *installer) writeFile(rel string, data []byte, perm os.FileMode) error {
+	if err := i.mkdir(filepath.Dir(rel)); err != nil {
+		return err
+	}
+	dst := filepath.Join(i.root, rel)
+	// Remove first so a running binary can be replaced.
+	os.Remove(dst)
+	if err := os.WriteFile(dst, data, perm); err != nil {
+		return fmt.Errorf("failed to install %s: %w", dst, err)
+	}
+	fmt.Printf("Installed %s\n", dst)
+	i.record.Files = append(i.record.Files, rel)
+	return nil
+}
+
+// readInstallRecord reads the record of the install into root.
+func readInstallRecord(root string) (*InstallRecord, error) {
+	recordPath := filepath.Join(root, installRecordDir, installRecordFile)
+	data, err := os.ReadFile(recordPath)
+	if err != nil {
+		return nil, err
+	}
+	var record InstallRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("invalid install record %s: %w", recordPath, err)
+	}
+	return &record, nil
+}
+
+// merge adds the files and directories of a previous install into the same root that are not recorded yet.
+// The previous directories go first, they were created before the ones of this install.
+func (r *InstallRecord) merge(previous *InstallRecord) {
+	for _, file := range previous.Files {
+		if !slices.Contains(r.Files, file) {
+			r.Files = append(r.Files, file)
+		}
+	}
+	dirs := slices.Clone(previous.Dirs)
+	for _, dir := range r.Dirs {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	r.Dirs = dirs
+}
+
+// UninstallFrom removes the files and directories recorded by InstallTo. Directories are only removed when empty.
+func UninstallFrom(prefix, destDir string) error {
+	root := installRoot(prefix, destDir)
+	record, err := readInstallRecord(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no install record found at %s", filepath.Join(root, installRecordDir, installRecordFile))
+		}
+		return err
+	}
+
+	var failed []string
+	for _, rel := range record.Files {
+		path := filepath.Join(root, rel)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			failed = append(failed, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		fmt.Printf("Removed %s\n", path)
+	}
+
+	dirs := append([]string(nil), record.Dirs...)
+	// Remove the deepest directories first.
+	sort.SliceStable(dirs, func(a, b int) bool { return len(dirs[a]) > len(dirs[b]) })
+	for _, rel := range dirs {
+		path := filepath.Join(root, rel)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			PrintYellow(fmt.Sprintf("Keeping directory %s: %v", path, err))
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove some files:\n%s", strings.Join(failed, "\n"))
+	}
+	PrintGreen(fmt.Sprintf("Uninstalled %d files from %s", len(record.Files), root))
+	return nil
+}
+
+// listRegularFiles returns the names of the regular files in dir, or nothing when dir doesn't exist. The log helper
+// is left out, installed instances log through their service manager.
+func listRegularFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.TrimSuffix(entry.Name(), ".exe") != logHelperName {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// countBinaries counts the files that are not build manifests.
+func countBinaries(names []string) int {
+	n := 0
+	for _, name := range names {
+		if name != BinaryManifestFile && name != BinaryManifestSigFile {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,284 @@
+package mageutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// BinaryManifestFile is written next to the compiled binaries of each platform.
+	BinaryManifestFile = "manifest.json"
+	// BinaryManifestSigFile holds the base64 ed25519 signature of the manifest.
+	BinaryManifestSigFile = "manifest.json.sig"
+
+	// SigningKeyEnv points to the PEM encoded ed25519 private key used to sign manifests at build time.
+	SigningKeyEnv = "GOMAKE_SIGNING_KEY"
+
+	signingKeyFile = "gomake-signing.key"
+	verifyKeyFile  = "gomake-signing.pub"
+)
+
+// BinaryManifest records the checksums of the binaries built by gomake for one platform.
+type BinaryManifest struct {
+	Platform    string                    `json:"platform"`
+	GeneratedAt time.Time                 `json:"generatedAt"`
+	Binaries    map[string]BinaryChecksum `json:"binaries"`
+}
+
+type BinaryChecksum struct {
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	BuiltAt time.Time `json:"builtAt"`
+}
+
+// BinaryVerification is the result of checking one binary against its manifest.
+type BinaryVerification struct {
+	Binary string
+	Path   string
+	Err    error
+}
+
+// fileSHA256 returns the hex encoded SHA-256 checksum of a file.
+func fileSHA256(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+func readBinaryManifest(dir string) (*BinaryManifest, []byte, error) {
+	data, err := os.ReadFile(filepath.Join(dir, BinaryManifestFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var manifest BinaryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest %s: %w", filepath.Join(dir, BinaryManifestFile), err)
+	}
+	if manifest.Binaries == nil {
+		manifest.Binaries = make(map[string]BinaryChecksum)
+	}
+	return &manifest, data, nil
+}
+
+// updateBinaryManifest records the checksums of freshly compiled binaries in the manifest of outputDir,
+// keeping the entries of binaries that were not rebuilt, and signs it when a signing key is configured.
+func updateBinaryManifest(outputDir, platform string, binaries []string) error {
+	manifest, _, err := readBinaryManifest(outputDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			PrintYellow(fmt.Sprintf("Discarding unreadable manifest: %v", err))
+		}
+		manifest = &BinaryManifest{Binaries: make(map[string]BinaryChecksum)}
+	}
+	manifest.Platform = platform
+	manifest.GeneratedAt = time.Now()
+
+	for _, binary := range binaries {
+		path := filepath.Join(outputDir, binary)
+		sum, size, err := fileSHA256(path)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", path, err)
+		}
+		manifest.Binaries[binary] = BinaryChecksum{SHA256: sum, Size: size, BuiltAt: manifest.GeneratedAt}
+	}
+	for binary := range manifest.Binaries {
+		if _, err := os.Stat(filepath.Join(outputDir, binary)); os.IsNotExist(err) {
+			delete(manifest.Binaries, binary)
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestPath := filepath.Join(outputDir, BinaryManifestFile)
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", manifestPath, err)
+	}
+
+	sigPath := filepath.Join(outputDir, BinaryManifestSigFile)
+	keyPath := os.Getenv(SigningKeyEnv)
+	if keyPath == "" {
+		// An old signature no longer matches the rewritten manifest.
+		os.Remove(sigPath)
+		return nil
+	}
+	key, err := loadSigningKey(keyPath)
+	if err != nil {
+		os.Remove(sigPath)
+		return err
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+	if err := os.WriteFile(sigPath, []byte(sig+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest signature %s: %w", sigPath, err)
+	}
+	PrintGreen(fmt.Sprintf("Signed manifest %s", manifestPath))
+	return nil
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("public key %s is not PEM encoded", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %s is not an ed25519 key", path)
+	}
+	return edKey, nil
+}
+
+// GenerateSigningKey writes a new ed25519 key pair to dir for signing and verifying binary manifests.
+func GenerateSigningKey(dir string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	privBytes, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+
+	privPath := filepath.Join(dir, signingKeyFile)
+	pubPath := filepath.Join(dir, verifyKeyFile)
+	if _, err := os.Stat(privPath); err == nil {
+		return fmt.Errorf("%s already exists", privPath)
+	}
+	if err := os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privBytes}), 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("Private key written to %s, export %s=%s when building", privPath, SigningKeyEnv, privPath))
+	PrintGreen(fmt.Sprintf("Public key written to %s, set verifyPublicKey in %s to require signed manifests", pubPath, StartConfigFile))
+	return nil
+}
+
+// VerifyBinary checks a binary against the manifest in its directory and, when a public key is given,
+// the manifest signature. A nil error means the binary is exactly the one gomake built.
+func VerifyBinary(binaryPath string, pubKey ed25519.PublicKey) error {
+	dir := filepath.Dir(binaryPath)
+	name := filepath.Base(binaryPath)
+
+	manifest, data, err := readBinaryManifest(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("no manifest found, binary was not built by gomake")
+		}
+		return err
+	}
+
+	if pubKey != nil {
+		sig, err := os.ReadFile(filepath.Join(dir, BinaryManifestSigFile))
+		if err != nil {
+			return errors.New("manifest is not signed")
+		}
+		rawSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || !ed25519.Verify(pubKey, data, rawSig) {
+			return errors.New("manifest signature is invalid")
+		}
+	}
+
+	expected, ok := manifest.Binaries[name]
+	if !ok {
+		return errors.New("binary is not listed in the manifest, it was not built by gomake")
+	}
+	sum, size, err := fileSHA256(binaryPath)
+	if err != nil {
+		return err
+	}
+	if size != expected.Size || sum != expected.SHA256 {
+		return fmt.Errorf("checksum mismatch, expected sha256 %s but got %s, binary has been modified", expected.SHA256, sum)
+	}
+	return nil
+}
+
+// VerifyBinaries verifies the given binaries, prints a report and returns the binaries that failed verification.
+func VerifyBinaries(binaryPaths map[string]string) (map[string]error, error) {
+	var pubKey ed25519.PublicKey
+	if verifyPublicKey != "" {
+		keyPath := verifyPublicKey
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(Paths.Root, keyPath)
+		}
+		key, err := loadVerifyKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		pubKey = key
+	}
+
+	names := make([]string, 0, len(binaryPaths))
+	for name := range binaryPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failed := make(map[string]error)
+	PrintBlue("Binary integrity verification report:")
+	for _, name := range names {
+		if err := VerifyBinary(binaryPaths[name], pubKey); err != nil {
+			failed[name] = err
+			PrintRedNoTimeStamp(fmt.Sprintf("  [REFUSED] %s: %v", name, err))
+			continue
+		}
+		PrintGreenNoTimeStamp(fmt.Sprintf("  [OK]      %s", name))
+	}
+	return failed, nil
+}
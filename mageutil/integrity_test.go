@@ -0,0 +1,239 @@
+package mageutil
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSigningKeys generates a key pair in a temporary directory and returns the paths of its private and public key.
+func testSigningKeys(t *testing.T) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := GenerateSigningKey(dir); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, signingKeyFile), filepath.Join(dir, verifyKeyFile)
+}
+
+// testBuiltBinaries writes the binaries api and rpc to a temporary directory and records them in its manifest,
+// signed with signingKey when it is not empty.
+func testBuiltBinaries(t *testing.T, signingKey string) string {
+	t.Helper()
+	t.Setenv(SigningKeyEnv, signingKey)
+	dir := t.TempDir()
+	for _, name := range []string{"api", "rpc"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("binary "+name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updateBinaryManifest(dir, "linux_amd64", []string{"api", "rpc"}); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyBinary(t *testing.T) {
+	signingKey, verifyKey := testSigningKeys(t)
+	otherSigningKey, _ := testSigningKeys(t)
+	pubKey, err := loadVerifyKey(verifyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		signingKey string            // Signs the manifest when not empty
+		pubKey     ed25519.PublicKey // Requires a valid signature when not nil
+		binary     string
+		modify     func(t *testing.T, dir string)
+		err        string
+	}{
+		{name: "unsigned", binary: "api"},
+		{name: "signed", signingKey: signingKey, pubKey: pubKey, binary: "api"},
+		{name: "signed without a required signature", signingKey: signingKey, binary: "api"},
+		{
+			name:   "tampered binary",
+			binary: "api",
+			modify: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, "api"), "binary apx") },
+			err:    "checksum mismatch",
+		},
+		{
+			name:   "truncated binary",
+			binary: "api",
+			modify: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, "api"), "binary") },
+			err:    "checksum mismatch",
+		},
+		{
+			name:   "binary not in the manifest",
+			binary: "worker",
+			modify: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, "worker"), "binary worker") },
+			err:    "binary is not listed in the manifest",
+		},
+		{
+			name:   "missing manifest",
+			binary: "api",
+			modify: func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, BinaryManifestFile)) },
+			err:    "no manifest found",
+		},
+		{
+			name:   "invalid manifest",
+			binary: "api",
+			modify: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, BinaryManifestFile), "{") },
+			err:    "invalid manifest",
+		},
+		{name: "missing signature", pubKey: pubKey, binary: "api", err: "manifest is not signed"},
+		{name: "signed with another key", signingKey: otherSigningKey, pubKey: pubKey, binary: "api", err: "manifest signature is invalid"},
+		{
+			name:       "malformed signature",
+			signingKey: signingKey,
+			pubKey:     pubKey,
+			binary:     "api",
+			modify: func(t *testing.T, dir string) {
+				writeTestFile(t, filepath.Join(dir, BinaryManifestSigFile), "not base64!\n")
+			},
+			err: "manifest signature is invalid",
+		},
+		{
+			name:       "manifest changed after signing",
+			signingKey: signingKey,
+			pubKey:     pubKey,
+			binary:     "api",
+			modify: func(t *testing.T, dir string) {
+				path := filepath.Join(dir, BinaryManifestFile)
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, path, strings.Replace(string(data), "linux_amd64", "linux_arm64", 1))
+			},
+			err: "manifest signature is invalid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testBuiltBinaries(t, tt.signingKey)
+			if tt.modify != nil {
+				tt.modify(t, dir)
+			}
+			err := VerifyBinary(filepath.Join(dir, tt.binary), tt.pubKey)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("VerifyBinary() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("VerifyBinary() error = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyBinaries(t *testing.T) {
+	signingKey, verifyKey := testSigningKeys(t)
+	key := verifyPublicKey
+	t.Cleanup(func() { verifyPublicKey = key })
+
+	tests := []struct {
+		name       string
+		signingKey string
+		verifyKey  string // verifyPublicKey of start-config.yml
+		modify     func(t *testing.T, dir string)
+		failed     map[string]string
+		err        string
+	}{
+		{name: "all verified", signingKey: signingKey, verifyKey: verifyKey, failed: map[string]string{}},
+		{
+			name:   "one tampered",
+			modify: func(t *testing.T, dir string) { writeTestFile(t, filepath.Join(dir, "rpc"), "binary rpx") },
+			failed: map[string]string{"rpc": "checksum mismatch"},
+		},
+		{
+			name:   "missing manifest",
+			modify: func(t *testing.T, dir string) { os.Remove(filepath.Join(dir, BinaryManifestFile)) },
+			failed: map[string]string{"api": "no manifest found", "rpc": "no manifest found"},
+		},
+		{
+			name:      "unsigned with a required signature",
+			verifyKey: verifyKey,
+			failed:    map[string]string{"api": "manifest is not signed", "rpc": "manifest is not signed"},
+		},
+		{name: "missing public key", verifyKey: filepath.Join(t.TempDir(), verifyKeyFile), err: "failed to read public key"},
+		{name: "public key is not PEM", verifyKey: signingKey + ".txt", err: "is not PEM encoded"},
+		{name: "private key as public key", verifyKey: signingKey, err: "failed to parse public key"},
+	}
+	writeTestFile(t, signingKey+".txt", "not a key")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testBuiltBinaries(t, tt.signingKey)
+			if tt.modify != nil {
+				tt.modify(t, dir)
+			}
+			verifyPublicKey = tt.verifyKey
+			failed, err := VerifyBinaries(map[string]string{"api": filepath.Join(dir, "api"), "rpc": filepath.Join(dir, "rpc")})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("VerifyBinaries() error = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyBinaries() error = %v", err)
+			}
+			if len(failed) != len(tt.failed) {
+				t.Errorf("VerifyBinaries() failed = %v, want %v", failed, tt.failed)
+			}
+			for name, want := range tt.failed {
+				if err := failed[name]; err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("%s: error = %v, want %s", name, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateBinaryManifestSigningKey(t *testing.T) {
+	signingKey, _ := testSigningKeys(t)
+	writeTestFile(t, signingKey+".txt", "not a key")
+
+	tests := []struct {
+		name       string
+		signingKey string // GOMAKE_SIGNING_KEY when rebuilding
+		signed     bool
+		err        string
+	}{
+		{name: "signed", signingKey: signingKey, signed: true},
+		{name: "unset drops the old signature"},
+		{name: "missing key", signingKey: filepath.Join(t.TempDir(), signingKeyFile), err: "failed to read signing key"},
+		{name: "key is not PEM", signingKey: signingKey + ".txt", err: "is not PEM encoded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first build is signed, so a signature left behind by the rebuild would show.
+			dir := testBuiltBinaries(t, signingKey)
+			t.Setenv(SigningKeyEnv, tt.signingKey)
+			err := updateBinaryManifest(dir, "linux_amd64", []string{"api"})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("updateBinaryManifest() error = %v, want %s", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatalf("updateBinaryManifest() error = %v", err)
+			}
+			_, err = os.Stat(filepath.Join(dir, BinaryManifestSigFile))
+			if signed := err == nil; signed != tt.signed {
+				t.Errorf("signed = %v, want %v", signed, tt.signed)
+			}
+		})
+	}
+}
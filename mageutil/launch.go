@@ -0,0 +1,141 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// defaultArgTemplate is the command line of services without an argTemplate.
+var defaultArgTemplate = []string{"-i", "{{.Index}}", "-c", "{{.ConfigDir}}"}
+
+// InstanceTemplateData is available in the argTemplate, args, env values and workDir of a service.
+type InstanceTemplateData struct {
+	Service   string // Service name without .exe
+	Index     int
+	ConfigDir string
+	Port      int // Port of the instance, 0 when the service has no port
+	Root      string
+
+	binDir string // Default working directory
+}
+
+// instanceLaunch is the command line, environment and working directory of an instance.
+type instanceLaunch struct {
+	Args []string
+	Env  []string // Added to the environment of mage
+	Dir  string
+}
+
+func newInstanceTemplateData(binary string, index, port int) InstanceTemplateData {
+	configPath := Paths.Config
+	if os.Getenv(DeploymentType) == KUBERNETES {
+		configPath = Paths.K8sConfig
+	}
+	return InstanceTemplateData{
+		Service:   strings.TrimSuffix(binary, ".exe"),
+		Index:     index,
+		ConfigDir: configPath,
+		Port:      port,
+		Root:      Paths.Root,
+		binDir:    Paths.OutputHostBin,
+	}
+}
+
+// launchSpec renders the templates of a service for one instance.
+func (s ServiceConfig) launchSpec(data InstanceTemplateData) (*instanceLaunch, error) {
+	render := func(field, text string) (string, error) {
+		return renderInstanceTemplate(field, text, data)
+	}
+
+	launch := &instanceLaunch{Dir: data.binDir}
+	argTemplate := s.ArgTemplate
+	if len(argTemplate) == 0 {
+		argTemplate = defaultArgTemplate
+	}
+	for _, arg := range append(append([]string{}, argTemplate...), s.Args...) {
+		value, err := render("argument", arg)
+		if err != nil {
+			return nil, err
+		}
+		launch.Args = append(launch.Args, value)
+	}
+
+	keys := make([]string, 0, len(s.Env))
+	for key := range s.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := render("env "+key, s.Env[key])
+		if err != nil {
+			return nil, err
+		}
+		launch.Env = append(launch.Env, key+"="+value)
+	}
+
+	if s.WorkDir != "" {
+		dir, err := render("workDir", s.WorkDir)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(data.Root, dir)
+		}
+		launch.Dir = dir
+	}
+	return launch, nil
+}
+
+// renderInstanceTemplate renders a Go template setting of a service, field names the setting in errors.
+func renderInstanceTemplate(field, text string, data InstanceTemplateData) (string, error) {
+	tmpl, err := template.New(field).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", field, text, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", field, text, err)
+	}
+	return b.String(), nil
+}
+
+// instanceAliases are the short placeholders accepted in probes and pre-stop URLs besides the Go templates.
+var instanceAliases = strings.NewReplacer("{index}", "{{.Index}}", "{port}", "{{.Port}}")
+
+// expandInstance renders a probe or pre-stop setting, a Go template like the launch settings in which {index} and
+// {port} are aliases of {{.Index}} and {{.Port}}.
+func expandInstance(field, text string, data InstanceTemplateData) (string, error) {
+	return renderInstanceTemplate(field, instanceAliases.Replace(text), data)
+}
+
+// processInstanceIndex returns the instance index of a service process from its marker or the state file, falling
+// back to the -i argument for instances that were not recorded.
+func processInstanceIndex(state *State, service string, p *process.Process) int {
+	if marker, _ := readInstanceMarker(p); marker != nil && marker.service == service {
+		return marker.index
+	}
+	if state != nil {
+		for _, inst := range state.InstancesOf(service) {
+			if int32(inst.PID) == p.Pid && inst.Process() != nil {
+				return inst.Index
+			}
+		}
+	}
+	args, _ := p.CmdlineSlice()
+	return instanceIndexFromArgs(args)
+}
+
+// loadStateOrEmpty reads the state file, ignoring a missing or invalid file.
+func loadStateOrEmpty() *State {
+	state, err := LoadState()
+	if err != nil {
+		return &State{}
+	}
+	return state
+}
@@ -0,0 +1,140 @@
+package mageutil
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testTemplateData() InstanceTemplateData {
+	root := filepath.Join(string(filepath.Separator), "srv", "app")
+	return InstanceTemplateData{
+		Service:   "api",
+		Index:     1,
+		ConfigDir: filepath.Join(root, "config"),
+		Port:      10002,
+		Root:      root,
+		binDir:    filepath.Join(root, "bin"),
+	}
+}
+
+func TestLaunchSpec(t *testing.T) {
+	data := testTemplateData()
+	absDir := filepath.Join(string(filepath.Separator), "var", "lib", "api")
+	tests := []struct {
+		name    string
+		service ServiceConfig
+		want    *instanceLaunch
+		err     string
+	}{
+		{
+			name:    "defaults",
+			service: ServiceConfig{Count: 1},
+			want:    &instanceLaunch{Args: []string{"-i", "1", "-c", data.ConfigDir}, Dir: data.binDir},
+		},
+		{
+			name:    "args after the default template",
+			service: ServiceConfig{Args: []string{"--port", "{{.Port}}"}},
+			want:    &instanceLaunch{Args: []string{"-i", "1", "-c", data.ConfigDir, "--port", "10002"}, Dir: data.binDir},
+		},
+		{
+			name: "argTemplate replaces the defaults",
+			service: ServiceConfig{
+				ArgTemplate: []string{"--name", "{{.Service}}-{{.Index}}"},
+				Args:        []string{"-v"},
+			},
+			want: &instanceLaunch{Args: []string{"--name", "api-1", "-v"}, Dir: data.binDir},
+		},
+		{
+			name: "env sorted by key",
+			service: ServiceConfig{
+				ArgTemplate: []string{"run"},
+				Env:         map[string]string{"PORT": "{{.Port}}", "INDEX": "{{.Index}}", "HOME": "{{.Root}}"},
+			},
+			want: &instanceLaunch{
+				Args: []string{"run"},
+				Env:  []string{"HOME=" + data.Root, "INDEX=1", "PORT=10002"},
+				Dir:  data.binDir,
+			},
+		},
+		{
+			name:    "relative workDir",
+			service: ServiceConfig{ArgTemplate: []string{"run"}, WorkDir: "data/{{.Service}}-{{.Index}}"},
+			want:    &instanceLaunch{Args: []string{"run"}, Dir: filepath.Join(data.Root, "data", "api-1")},
+		},
+		{
+			name:    "absolute workDir",
+			service: ServiceConfig{ArgTemplate: []string{"run"}, WorkDir: absDir},
+			want:    &instanceLaunch{Args: []string{"run"}, Dir: absDir},
+		},
+		{
+			name:    "unknown field",
+			service: ServiceConfig{Args: []string{"{{.Name}}"}},
+			err:     `invalid argument "{{.Name}}"`,
+		},
+		{
+			name:    "invalid env template",
+			service: ServiceConfig{Env: map[string]string{"PORT": "{{.Port"}},
+			err:     `invalid env PORT "{{.Port"`,
+		},
+		{
+			name:    "invalid workDir template",
+			service: ServiceConfig{WorkDir: "{{if}}"},
+			err:     `invalid workDir "{{if}}"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.service.launchSpec(data)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("launchSpec() error = %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("launchSpec() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("launchSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandInstance(t *testing.T) {
+	data := testTemplateData()
+	tests := []struct {
+		name string
+		text string
+		want string
+		err  string
+	}{
+		{name: "plain", text: "127.0.0.1:10002", want: "127.0.0.1:10002"},
+		{name: "aliases", text: "http://127.0.0.1:{port}/ready?i={index}", want: "http://127.0.0.1:10002/ready?i=1"},
+		{name: "templates", text: "http://127.0.0.1:{{.Port}}/{{.Service}}/{{.Index}}", want: "http://127.0.0.1:10002/api/1"},
+		{name: "aliases and templates", text: "{{.Service}}-{index}", want: "api-1"},
+		{name: "functions", text: "127.0.0.1:{{printf \"%d\" .Port}}", want: "127.0.0.1:10002"},
+		{name: "unknown field", text: "{{.Name}}", err: `invalid probe "{{.Name}}"`},
+		{name: "unclosed action", text: "{{.Port", err: `invalid probe "{{.Port"`},
+		{name: "unknown alias left alone", text: "{service}", want: "{service}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandInstance("probe", tt.text, data)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("expandInstance(%q) error = %v, want %s", tt.text, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandInstance(%q) error = %v", tt.text, err)
+			}
+			if got != tt.want {
+				t.Errorf("expandInstance(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
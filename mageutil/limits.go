@@ -0,0 +1,92 @@
+package mageutil
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultCgroup is the cgroup v2 subtree, relative to the cgroup mount, in which instances with memory or cpu
+// limits get their own cgroup.
+const defaultCgroup = "gomake"
+
+// cgroupRoot is the cgroup v2 subtree configured by the top-level cgroup setting.
+var cgroupRoot string
+
+// LimitsConfig are the resource limits of each instance of a service. The rlimits are applied to the process
+// right after it is started, values above the hard limit of mage are capped with a warning. Memory and CPU are
+// applied through cgroup v2 and require a writable, delegated subtree, see the top-level cgroup setting.
+type LimitsConfig struct {
+	OpenFiles    *LimitValue `yaml:"openFiles"`    // RLIMIT_NOFILE
+	CoreSize     *LimitValue `yaml:"coreSize"`     // RLIMIT_CORE in bytes, e.g. 0 or unlimited
+	AddressSpace *LimitValue `yaml:"addressSpace"` // RLIMIT_AS in bytes, e.g. 4G
+	Processes    *LimitValue `yaml:"processes"`    // RLIMIT_NPROC, counted per user
+	Memory       *LimitValue `yaml:"memory"`       // cgroup v2 memory.max in bytes, e.g. 512M
+	CPU          float64     `yaml:"cpu"`          // cgroup v2 cpu.max in CPUs, e.g. 1.5
+}
+
+// LimitValue is a resource limit written as a number, a size with a K, M, G or T suffix (powers of 1024) or
+// "unlimited".
+type LimitValue uint64
+
+// Unlimited is the LimitValue of "unlimited".
+const Unlimited = LimitValue(math.MaxUint64)
+
+func (v *LimitValue) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseLimitValue(value.Value)
+	if err != nil {
+		// A TypeError lets the decoder go on and report the other errors of the file too.
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %v", value.Line, err)}}
+	}
+	*v = parsed
+	return nil
+}
+
+func (v LimitValue) String() string {
+	if v == Unlimited {
+		return "unlimited"
+	}
+	return strconv.FormatUint(uint64(v), 10)
+}
+
+func parseLimitValue(text string) (LimitValue, error) {
+	s := strings.TrimSpace(text)
+	if strings.EqualFold(s, "unlimited") || strings.EqualFold(s, "infinity") {
+		return Unlimited, nil
+	}
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]&^0x20); i >= 0 {
+			multiplier = 1 << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > math.MaxUint64/multiplier {
+		return 0, fmt.Errorf("invalid limit %q, expected a number, a size such as 512M or unlimited", text)
+	}
+	return LimitValue(n * multiplier), nil
+}
+
+// empty reports whether no limit is set.
+func (l LimitsConfig) empty() bool {
+	return l.OpenFiles == nil && l.CoreSize == nil && l.AddressSpace == nil && l.Processes == nil && !l.cgroupLimited()
+}
+
+// cgroupLimited reports whether the limits need a cgroup.
+func (l LimitsConfig) cgroupLimited() bool {
+	return l.Memory != nil || l.CPU > 0
+}
+
+func (l LimitsConfig) validate() error {
+	if l.CPU < 0 {
+		return fmt.Errorf("limits.cpu must not be negative")
+	}
+	if l.OpenFiles != nil && *l.OpenFiles == 0 {
+		return fmt.Errorf("limits.openFiles must be positive")
+	}
+	return nil
+}
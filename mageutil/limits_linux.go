@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package mageutil
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	cgroupMount     = "/sys/fs/cgroup"
+	cgroupCPUPeriod = 100000 // Microseconds, the default period of cpu.max
+)
+
+// applyInstanceLimits applies the resource limits of a service to a started instance. Limits that can't be
+// applied are reported as warnings, the instance keeps running.
+func applyInstanceLimits(binary string, index int, pid int, limits LimitsConfig) {
+	name := fmt.Sprintf("%s[%d]", binary, index)
+	rlimits := []struct {
+		name     string
+		resource int
+		value    *LimitValue
+	}{
+		{"openFiles", unix.RLIMIT_NOFILE, limits.OpenFiles},
+		{"coreSize", unix.RLIMIT_CORE, limits.CoreSize},
+		{"addressSpace", unix.RLIMIT_AS, limits.AddressSpace},
+		{"processes", unix.RLIMIT_NPROC, limits.Processes},
+	}
+	for _, r := range rlimits {
+		if r.value == nil {
+			continue
+		}
+		if err := setProcessRlimit(pid, r.resource, uint64(*r.value)); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to set the %s limit of %s to %s: %v", r.name, name, r.value, err))
+		} else if capped := currentRlimit(pid, r.resource); capped < uint64(*r.value) {
+			PrintYellow(fmt.Sprintf("The %s limit of %s was capped at the hard limit %s instead of %s", r.name, name, LimitValue(capped), r.value))
+		}
+	}
+
+	if limits.cgroupLimited() {
+		if err := applyCgroupLimits(binary, index, pid, limits); err != nil {
+			PrintYellow(fmt.Sprintf("Memory and cpu limits of %s were not applied: %v", name, err))
+		}
+	}
+}
+
+// setProcessRlimit sets the soft and hard limit of a process, capped at the current hard limit when mage isn't
+// allowed to raise it.
+func setProcessRlimit(pid int, resource int, value uint64) error {
+	limit := unix.Rlimit{Cur: value, Max: value}
+	err := unix.Prlimit(pid, resource, &limit, nil)
+	if !errors.Is(err, unix.EPERM) {
+		return err
+	}
+	var old unix.Rlimit
+	if err := unix.Prlimit(pid, resource, nil, &old); err != nil {
+		return err
+	}
+	if value <= old.Max {
+		return err
+	}
+	limit = unix.Rlimit{Cur: old.Max, Max: old.Max}
+	return unix.Prlimit(pid, resource, &limit, nil)
+}
+
+// currentRlimit returns the soft limit of a process, or the largest value when it can't be read.
+func currentRlimit(pid int, resource int) uint64 {
+	var limit unix.Rlimit
+	if err := unix.Prlimit(pid, resource, nil, &limit); err != nil {
+		return uint64(Unlimited)
+	}
+	return limit.Cur
+}
+
+// applyCgroupLimits moves an instance into its own cgroup below the configured subtree and sets memory.max and
+// cpu.max. The subtree must be a cgroup v2 directory mage may write to and which holds no processes itself.
+func applyCgroupLimits(binary string, index int, pid int, limits LimitsConfig) error {
+	if _, err := os.Stat(filepath.Join(cgroupMount, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 is not mounted at %s", cgroupMount)
+	}
+	root := cgroupRoot
+	if root == "" {
+		root = defaultCgroup
+	}
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(cgroupMount, root)
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("no writable delegated cgroup v2 subtree, set cgroup in %s: %v", startConfigPath(), err)
+	}
+
+	var controllers []string
+	if limits.Memory != nil {
+		controllers = append(controllers, "memory")
+	}
+	if limits.CPU > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	available, err := readCgroupList(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	enabled, err := readCgroupList(filepath.Join(root, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	for _, controller := range controllers {
+		if enabled[controller] {
+			continue
+		}
+		if !available[controller] {
+			return fmt.Errorf("the %s controller is not delegated to %s", controller, root)
+		}
+		if err := writeCgroupFile(root, "cgroup.subtree_control", "+"+controller); err != nil {
+			return err
+		}
+	}
+
+	dir := filepath.Join(root, fmt.Sprintf("%s-%d", strings.TrimSuffix(binary, ".exe"), index))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	memory, cpu := "max", "max"
+	if limits.Memory != nil && *limits.Memory != Unlimited {
+		memory = strconv.FormatUint(uint64(*limits.Memory), 10)
+	}
+	if limits.CPU > 0 {
+		cpu = strconv.Itoa(int(limits.CPU * cgroupCPUPeriod))
+	}
+	leaf, err := readCgroupList(filepath.Join(dir, "cgroup.controllers"))
+	if err != nil {
+		return err
+	}
+	if leaf["memory"] {
+		if err := writeCgroupFile(dir, "memory.max", memory); err != nil {
+			return err
+		}
+	}
+	if leaf["cpu"] {
+		if err := writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%s %d", cpu, cgroupCPUPeriod)); err != nil {
+			return err
+		}
+	}
+	return writeCgroupFile(dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// readCgroupList reads a space separated cgroup file such as cgroup.controllers.
+func readCgroupList(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		list[scanner.Text()] = true
+	}
+	return list, scanner.Err()
+}
+
+func writeCgroupFile(dir, name, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return fmt.Errorf("failed to write %q to %s: %v", value, filepath.Join(dir, name), err)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package mageutil
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// applyInstanceLimits reports configured resource limits, they are only supported on Linux.
+func applyInstanceLimits(binary string, index int, pid int, limits LimitsConfig) {
+	if !limits.empty() {
+		PrintYellow(fmt.Sprintf("Resource limits of %s[%d] were not applied, they are not supported on %s", binary, index, runtime.GOOS))
+	}
+}
@@ -0,0 +1,76 @@
+package mageutil
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseLimitValue(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    LimitValue
+		wantErr bool
+	}{
+		{text: "0", want: 0},
+		{text: "65536", want: 65536},
+		{text: " 1024 ", want: 1024},
+		{text: "1K", want: 1 << 10},
+		{text: "512M", want: 512 << 20},
+		{text: "512m", want: 512 << 20},
+		{text: "4G", want: 4 << 30},
+		{text: "2T", want: 2 << 40},
+		{text: "unlimited", want: Unlimited},
+		{text: "Infinity", want: Unlimited},
+		{text: "16777215T", want: 16777215 << 40},
+		{text: "16777216T", wantErr: true},
+		{text: "", wantErr: true},
+		{text: "M", wantErr: true},
+		{text: "-1", wantErr: true},
+		{text: "1.5G", wantErr: true},
+		{text: "10P", wantErr: true},
+		{text: "lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseLimitValue(tt.text)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseLimitValue(%q) = %d, want an error", tt.text, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLimitValue(%q) error = %v", tt.text, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseLimitValue(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitValueUnmarshalYAML(t *testing.T) {
+	var limits LimitsConfig
+	err := yaml.Unmarshal([]byte("openFiles: 4096\nmemory: lots\ncoreSize: 1x\n"), &limits)
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		t.Fatalf("error = %v, want a *yaml.TypeError", err)
+	}
+	// Decoding goes on after an invalid value, so every error is reported with its line.
+	want := []string{
+		`line 2: invalid limit "lots", expected a number, a size such as 512M or unlimited`,
+		`line 3: invalid limit "1x", expected a number, a size such as 512M or unlimited`,
+	}
+	if len(typeErr.Errors) != len(want) {
+		t.Fatalf("errors = %q, want %q", typeErr.Errors, want)
+	}
+	for i := range want {
+		if typeErr.Errors[i] != want[i] {
+			t.Errorf("errors[%d] = %q, want %q", i, typeErr.Errors[i], want[i])
+		}
+	}
+	if limits.OpenFiles == nil || *limits.OpenFiles != 4096 {
+		t.Errorf("openFiles = %v, want 4096", limits.OpenFiles)
+	}
+}
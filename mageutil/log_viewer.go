@@ -0,0 +1,499 @@
+package mageutil
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	logFollowInterval = 250 * time.Millisecond
+	logLevelUnknown   = -2
+)
+
+var logPrefixColors = []string{ColorBlue, ColorGreen, ColorYellow, "\033[0;35m", "\033[0;36m", ColorRed}
+
+var logLevels = map[string]int{
+	"trace":    -1,
+	"debug":    0,
+	"info":     1,
+	"warn":     2,
+	"warning":  2,
+	"error":    3,
+	"dpanic":   4,
+	"panic":    4,
+	"fatal":    4,
+	"critical": 4,
+}
+
+var (
+	logTimestampPattern = regexp.MustCompile(`^\[?(\d{4}[-/]\d{2}[-/]\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)`)
+	logLevelPattern     = regexp.MustCompile(`\blevel=(\w+)|\b(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|DPANIC|PANIC|FATAL|CRITICAL)\b`)
+	logTimestampLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999"}
+)
+
+// LogsOptions filters the output of `mage logs`.
+type LogsOptions struct {
+	Follow bool
+	Since  time.Duration
+	Grep   *regexp.Regexp
+	Level  string
+	Tail   int // Number of lines shown before following, 0 shows all
+}
+
+// logLine is a line of an instance log with the timestamp and level detected in it or inherited from the previous line.
+type logLine struct {
+	source *logSource
+	text   string
+	time   time.Time
+	level  int
+}
+
+// logSource reads the log of one instance, the rotated files first when they are requested.
+type logSource struct {
+	name    string
+	color   string
+	path    string
+	history []string // Rotated files, oldest first
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64 // Bytes of the current file consumed by reader
+	partial string
+	time    time.Time
+	level   int
+}
+
+// Logs prints the output of service instances, e.g. `mage logs openim-api:0 -f --level error`.
+func Logs(args []string) {
+	targets, opts, err := parseLogsArgs(args)
+	if err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	if err := ShowLogs(targets, opts); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+}
+
+// parseLogsArgs returns the targets and options of `mage logs`.
+func parseLogsArgs(args []string) ([]string, *LogsOptions, error) {
+	flags := newFlagSet("logs")
+	follow := flags.Bool("f", false, "follow the logs")
+	flags.BoolVar(follow, "follow", false, "follow the logs")
+	since := flags.Duration("since", 0, "only show lines newer than this, e.g. 10m")
+	grep := flags.String("grep", "", "only show lines matching this regular expression")
+	level := flags.String("level", "", "only show lines of this level or above, e.g. warn")
+	tail := flags.Int("tail", 100, "number of lines shown before following, 0 shows all")
+	targets, err := parseArgs(flags, args)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid logs arguments: %v", err)
+	}
+
+	opts := &LogsOptions{Follow: *follow, Since: *since, Level: strings.ToLower(*level), Tail: *tail}
+	if *grep != "" {
+		if opts.Grep, err = regexp.Compile(*grep); err != nil {
+			return nil, nil, fmt.Errorf("invalid --grep pattern: %v", err)
+		}
+	}
+	if opts.Level != "" {
+		if _, ok := logLevels[opts.Level]; !ok {
+			return nil, nil, fmt.Errorf("unknown log level %q", *level)
+		}
+	}
+	return targets, opts, nil
+}
+
+// ShowLogs prints the logs of the given `service` or `service:index` targets, or of every instance, merged in timestamp order.
+func ShowLogs(targets []string, opts *LogsOptions) error {
+	paths, err := resolveLogTargets(targets)
+	if err != nil {
+		return err
+	}
+
+	sources := newLogSources(paths, opts)
+	defer func() {
+		for _, src := range sources {
+			if src.file != nil {
+				src.file.Close()
+			}
+		}
+	}()
+
+	filter := newLogFilter(opts)
+	if err := readLogs(sources, filter, opts.Tail, (*logLine).print); err != nil {
+		return err
+	}
+
+	if !opts.Follow {
+		return nil
+	}
+	for {
+		time.Sleep(logFollowInterval)
+		var lines []*logLine
+		for _, src := range sources {
+			lines = append(lines, src.follow()...)
+		}
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].time.Before(lines[j].time) })
+		for _, line := range lines {
+			if filter(line) {
+				line.print()
+			}
+		}
+	}
+}
+
+// newLogSources returns a source for each instance log, prefixed with the instance name in a color of its own.
+func newLogSources(paths []string, opts *LogsOptions) []*logSource {
+	var sources []*logSource
+	for i, path := range paths {
+		rel, _ := filepath.Rel(Paths.OutputLogs, path)
+		service, index := filepath.Split(rel)
+		src := &logSource{
+			name:  strings.TrimSuffix(filepath.Clean(service), string(filepath.Separator)) + "-" + strings.TrimSuffix(index, ".log"),
+			color: logPrefixColors[i%len(logPrefixColors)],
+			path:  path,
+			level: logLevelUnknown,
+		}
+		if opts.Since > 0 {
+			src.history = rotatedLogFiles(path, time.Now().Add(-opts.Since))
+		}
+		sources = append(sources, src)
+	}
+	return sources
+}
+
+// readLogs emits the lines of the sources that pass the filter in timestamp order, only the last tail lines unless
+// tail is 0.
+func readLogs(sources []*logSource, filter func(*logLine) bool, tail int, emit func(*logLine)) error {
+	var last []*logLine
+	err := mergeLogSources(sources, func(line *logLine) {
+		if !filter(line) {
+			return
+		}
+		if tail <= 0 {
+			emit(line)
+			return
+		}
+		last = append(last, line)
+		if len(last) > tail {
+			last = last[1:]
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range last {
+		emit(line)
+	}
+	return nil
+}
+
+// resolveLogTargets maps `service` and `service:index` targets to log files, no target selects every instance.
+func resolveLogTargets(targets []string) ([]string, error) {
+	entries, err := os.ReadDir(Paths.OutputLogs)
+	if err != nil {
+		return nil, fmt.Errorf("no logs found in %s: %v", Paths.OutputLogs, err)
+	}
+	var services []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			services = append(services, entry.Name())
+		}
+	}
+	instanceLogs := func(service string) []string {
+		matches, _ := filepath.Glob(filepath.Join(Paths.OutputLogs, service, "*.log"))
+		sort.Slice(matches, func(i, j int) bool {
+			a, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(matches[i]), ".log"))
+			b, _ := strconv.Atoi(strings.TrimSuffix(filepath.Base(matches[j]), ".log"))
+			return a < b
+		})
+		return matches
+	}
+
+	if len(targets) == 0 {
+		var paths []string
+		for _, service := range services {
+			paths = append(paths, instanceLogs(service)...)
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no logs found in %s", Paths.OutputLogs)
+		}
+		return paths, nil
+	}
+
+	var paths []string
+	for _, target := range targets {
+		service, index, hasIndex := strings.Cut(target, ":")
+		service = strings.TrimSuffix(service, ".exe")
+		if hasIndex {
+			n, err := strconv.Atoi(index)
+			if err != nil {
+				return nil, fmt.Errorf("invalid instance index in %q", target)
+			}
+			path := instanceLogPath(service, n)
+			if !fileExists(path) {
+				return nil, fmt.Errorf("no log found for %s at %s", target, path)
+			}
+			paths = append(paths, path)
+			continue
+		}
+		logs := instanceLogs(service)
+		if len(logs) == 0 {
+			return nil, fmt.Errorf("no logs found for %s in %s", service, filepath.Join(Paths.OutputLogs, service))
+		}
+		paths = append(paths, logs...)
+	}
+	return paths, nil
+}
+
+// rotatedLogFiles returns the rotated files of a log modified after since, oldest first.
+func rotatedLogFiles(path string, since time.Time) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	type rotatedFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []rotatedFile
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() && info.ModTime().After(since) {
+			files = append(files, rotatedFile{match, info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.path)
+	}
+	return paths
+}
+
+func newLogFilter(opts *LogsOptions) func(*logLine) bool {
+	minLevel := logLevelUnknown
+	if opts.Level != "" {
+		minLevel = logLevels[opts.Level]
+	}
+	var since time.Time
+	if opts.Since > 0 {
+		since = time.Now().Add(-opts.Since)
+	}
+	return func(line *logLine) bool {
+		if minLevel != logLevelUnknown && line.level < minLevel {
+			return false
+		}
+		// Lines without a known timestamp are kept, their file was already selected by modification time.
+		if !since.IsZero() && !line.time.IsZero() && line.time.Before(since) {
+			return false
+		}
+		return opts.Grep == nil || opts.Grep.MatchString(line.text)
+	}
+}
+
+// mergeLogSources reads every source to its end and emits the lines in timestamp order, keeping the order within a source.
+func mergeLogSources(sources []*logSource, emit func(*logLine)) error {
+	type cursor struct {
+		lines []*logLine
+		next  int
+	}
+	var cursors []*cursor
+	for _, src := range sources {
+		lines, err := src.readInitial()
+		if err != nil {
+			return err
+		}
+		cursors = append(cursors, &cursor{lines: lines})
+	}
+	for {
+		var best *cursor
+		for _, c := range cursors {
+			if c.next < len(c.lines) && (best == nil || c.lines[c.next].time.Before(best.lines[best.next].time)) {
+				best = c
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		emit(best.lines[best.next])
+		best.next++
+	}
+}
+
+// readInitial reads the requested rotated files and the current log, leaving the current log open for following.
+func (src *logSource) readInitial() ([]*logLine, error) {
+	var lines []*logLine
+	for _, path := range src.history {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(path, ".gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("failed to read %s: %v", path, err)
+			}
+			r = zr
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			lines = append(lines, src.parse(scanner.Text()))
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	if err := src.open(); err != nil {
+		return nil, err
+	}
+	return append(lines, src.readAvailable()...), nil
+}
+
+func (src *logSource) open() error {
+	f, err := os.Open(src.path)
+	if err != nil {
+		return err
+	}
+	src.file = f
+	src.reader = bufio.NewReader(f)
+	src.offset = 0
+	src.partial = ""
+	return nil
+}
+
+// readAvailable returns the complete lines written since the last read, keeping an unterminated last line for later.
+func (src *logSource) readAvailable() []*logLine {
+	var lines []*logLine
+	for {
+		chunk, err := src.reader.ReadString('\n')
+		src.offset += int64(len(chunk))
+		src.partial += chunk
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, src.parse(strings.TrimRight(src.partial, "\r\n")))
+		src.partial = ""
+	}
+}
+
+// follow returns the lines appended since the last call, switching to the new file after a rotation.
+func (src *logSource) follow() []*logLine {
+	if src.file == nil {
+		if err := src.open(); err != nil {
+			return nil
+		}
+	}
+	lines := src.readAvailable()
+	current, err := src.file.Stat()
+	if err != nil {
+		return lines
+	}
+	info, err := os.Stat(src.path)
+	if err != nil {
+		return lines
+	}
+	switch {
+	case !os.SameFile(current, info):
+		if src.partial != "" {
+			lines = append(lines, src.parse(src.partial))
+		}
+		src.file.Close()
+		src.file = nil
+		if err := src.open(); err == nil {
+			lines = append(lines, src.readAvailable()...)
+		}
+	case info.Size() < src.offset:
+		// The file was truncated in place.
+		src.file.Seek(0, io.SeekStart)
+		src.reader.Reset(src.file)
+		src.offset = 0
+		src.partial = ""
+	}
+	return lines
+}
+
+// parse detects the timestamp and level of a line, lines without them inherit those of the previous line of the source.
+func (src *logSource) parse(text string) *logLine {
+	ts, level, ok := parseStructuredLogLine(text)
+	if !ok {
+		if m := logTimestampPattern.FindStringSubmatch(text); m != nil {
+			ts = parseLogTimestamp(strings.Replace(m[1], ",", ".", 1))
+		}
+		if m := logLevelPattern.FindStringSubmatch(text); m != nil {
+			level = m[1] + m[2]
+		}
+	}
+	if !ts.IsZero() {
+		src.time = ts
+	}
+	if rank, known := logLevels[strings.ToLower(level)]; known {
+		src.level = rank
+	}
+	return &logLine{source: src, text: text, time: src.time, level: src.level}
+}
+
+// parseStructuredLogLine reads the timestamp and level of a JSON log line.
+func parseStructuredLogLine(text string) (time.Time, string, bool) {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "{") {
+		return time.Time{}, "", false
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return time.Time{}, "", false
+	}
+	var ts time.Time
+	for _, key := range []string{"time", "ts", "timestamp", "@timestamp", "t"} {
+		switch v := fields[key].(type) {
+		case string:
+			ts = parseLogTimestamp(v)
+		case float64:
+			if v > 1e12 {
+				ts = time.UnixMilli(int64(v))
+			} else {
+				sec := int64(v)
+				ts = time.Unix(sec, int64((v-float64(sec))*1e9))
+			}
+		}
+		if !ts.IsZero() {
+			break
+		}
+	}
+	var level string
+	for _, key := range []string{"level", "lvl", "severity", "L"} {
+		if v, ok := fields[key].(string); ok {
+			level = v
+			break
+		}
+	}
+	return ts, level, true
+}
+
+func parseLogTimestamp(value string) time.Time {
+	// Go's log package writes 2006/01/02.
+	value = strings.Replace(value, "/", "-", 2)
+	for _, layout := range logTimestampLayouts {
+		if ts, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return ts
+		}
+	}
+	return time.Time{}
+}
+
+func (line *logLine) print() {
+	fmt.Printf("%s%s |%s %s\n", line.source.color, line.source.name, ColorReset, line.text)
+}
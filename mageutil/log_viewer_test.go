@@ -0,0 +1,277 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogsArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		targets []string
+		want    LogsOptions
+		grep    string
+		err     string
+	}{
+		{name: "defaults", want: LogsOptions{Tail: 100}},
+		{
+			name:    "targets between flags",
+			args:    []string{"openim-api", "-f", "openim-rpc-user:1", "--since", "10m", "--tail", "0"},
+			targets: []string{"openim-api", "openim-rpc-user:1"},
+			want:    LogsOptions{Follow: true, Since: 10 * time.Minute},
+		},
+		{name: "level is case insensitive", args: []string{"--level", "WARN"}, want: LogsOptions{Level: "warn", Tail: 100}},
+		{name: "grep", args: []string{"--grep", "user [0-9]+"}, want: LogsOptions{Tail: 100}, grep: "user [0-9]+"},
+		{name: "unknown level", args: []string{"--level", "loud"}, err: `unknown log level "loud"`},
+		{name: "invalid grep", args: []string{"--grep", "("}, err: "invalid --grep pattern"},
+		{name: "invalid since", args: []string{"--since", "yesterday"}, err: "invalid logs arguments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, opts, err := parseLogsArgs(tt.args)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("parseLogsArgs(%q) error = %v, want %s", tt.args, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLogsArgs(%q) error = %v", tt.args, err)
+			}
+			if !reflect.DeepEqual(targets, tt.targets) {
+				t.Errorf("targets = %q, want %q", targets, tt.targets)
+			}
+			var grep string
+			if opts.Grep != nil {
+				grep = opts.Grep.String()
+			}
+			if grep != tt.grep {
+				t.Errorf("grep = %q, want %q", grep, tt.grep)
+			}
+			opts.Grep = nil
+			if *opts != tt.want {
+				t.Errorf("options = %+v, want %+v", *opts, tt.want)
+			}
+		})
+	}
+}
+
+// testLogFile is a log file below the logs directory, modified age ago.
+type testLogFile struct {
+	path  string
+	lines []string
+	age   time.Duration
+}
+
+// useTestLogs writes the files to a temporary logs directory for the duration of a test.
+func useTestLogs(t *testing.T, files []testLogFile) {
+	t.Helper()
+	paths := Paths
+	t.Cleanup(func() { Paths = paths })
+	Paths = &PathConfig{OutputLogs: t.TempDir()}
+
+	for _, f := range files {
+		path := filepath.Join(Paths.OutputLogs, filepath.FromSlash(f.path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(strings.Join(f.lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modTime := time.Now().Add(-f.age)
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadLogs(t *testing.T) {
+	// Timestamps without a zone are local, keep them comparable with those in UTC.
+	local := time.Local
+	t.Cleanup(func() { time.Local = local })
+	time.Local = time.UTC
+
+	now := time.Now()
+	at := func(ago time.Duration) string { return now.Add(-ago).Format(time.RFC3339) }
+	numbered := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%s line %d", at(time.Duration(n-i)*time.Second), i+1)
+		}
+		return lines
+	}
+
+	tests := []struct {
+		name    string
+		files   []testLogFile
+		targets []string
+		args    []string
+		want    []string // Source name and text of the shown lines
+		count   int      // Number of shown lines, checked instead of want when not 0
+	}{
+		{
+			name: "merged by timestamp",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{"2024-01-01T10:00:00Z api started", "2024-01-01 10:00:02 api ready"}},
+				{path: "api/1.log", lines: []string{"2024/01/01 10:00:01 second api"}},
+				{path: "rpc/0.log", lines: []string{
+					`{"ts":"2024-01-01T10:00:01.500Z","level":"info","msg":"rpc started"}`,
+					`{"time":1704103203000,"msg":"rpc listening"}`,
+				}},
+			},
+			want: []string{
+				"api-0 2024-01-01T10:00:00Z api started",
+				"api-1 2024/01/01 10:00:01 second api",
+				`rpc-0 {"ts":"2024-01-01T10:00:01.500Z","level":"info","msg":"rpc started"}`,
+				"api-0 2024-01-01 10:00:02 api ready",
+				`rpc-0 {"time":1704103203000,"msg":"rpc listening"}`,
+			},
+		},
+		{
+			name: "lines without a timestamp stay after the previous line",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{"2024-01-01T10:00:00Z panic: boom", "goroutine 1 [running]:", "2024-01-01T10:00:03Z restarted"}},
+				{path: "rpc/0.log", lines: []string{"2024-01-01T10:00:01Z rpc started"}},
+			},
+			want: []string{
+				"api-0 2024-01-01T10:00:00Z panic: boom",
+				"api-0 goroutine 1 [running]:",
+				"rpc-0 2024-01-01T10:00:01Z rpc started",
+				"api-0 2024-01-01T10:00:03Z restarted",
+			},
+		},
+		{
+			name: "selected targets",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{"2024-01-01T10:00:00Z api 0"}},
+				{path: "api/1.log", lines: []string{"2024-01-01T10:00:01Z api 1"}},
+				{path: "rpc/0.log", lines: []string{"2024-01-01T10:00:02Z rpc 0"}},
+			},
+			targets: []string{"rpc", "api:1"},
+			want:    []string{"api-1 2024-01-01T10:00:01Z api 1", "rpc-0 2024-01-01T10:00:02Z rpc 0"},
+		},
+		{
+			name: "level",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{
+					"2024-01-01T10:00:00Z INFO started",
+					"2024-01-01T10:00:01Z WARN slow request",
+					"2024-01-01T10:00:02Z level=error failed",
+					"  at main.go:10",
+					"2024-01-01T10:00:03Z DEBUG retrying",
+					"2024-01-01T10:00:04Z no level, inherits debug",
+				}},
+				{path: "rpc/0.log", lines: []string{
+					"2024-01-01T10:00:00Z no level yet",
+					`{"ts":"2024-01-01T10:00:05Z","level":"fatal","msg":"exiting"}`,
+					"2024-01-01T10:00:06Z no level, inherits fatal",
+				}},
+			},
+			args: []string{"--level", "warn"},
+			want: []string{
+				"api-0 2024-01-01T10:00:01Z WARN slow request",
+				"api-0 2024-01-01T10:00:02Z level=error failed",
+				"api-0   at main.go:10",
+				`rpc-0 {"ts":"2024-01-01T10:00:05Z","level":"fatal","msg":"exiting"}`,
+				"rpc-0 2024-01-01T10:00:06Z no level, inherits fatal",
+			},
+		},
+		{
+			name: "grep",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{"2024-01-01T10:00:00Z user 1 logged in", "2024-01-01T10:00:02Z user x logged in"}},
+				{path: "rpc/0.log", lines: []string{"2024-01-01T10:00:01Z user 22 logged out"}},
+			},
+			args: []string{"--grep", "user [0-9]+"},
+			want: []string{"api-0 2024-01-01T10:00:00Z user 1 logged in", "rpc-0 2024-01-01T10:00:01Z user 22 logged out"},
+		},
+		{
+			name: "since reads rotated files",
+			files: []testLogFile{
+				{path: "api/0.log.20240101-000000.gz", lines: []string{"never read, too old"}, age: 3 * time.Hour},
+				{path: "api/0.log.1", lines: []string{at(2*time.Hour) + " too old", at(50*time.Minute) + " rotated"}, age: 40 * time.Minute},
+				{path: "api/0.log", lines: []string{at(30*time.Minute) + " current", "no timestamp"}},
+				{path: "rpc/0.log", lines: []string{at(2*time.Hour) + " rpc too old", at(10*time.Minute) + " rpc"}},
+			},
+			args: []string{"--since", "1h"},
+			want: []string{
+				"api-0 " + at(50*time.Minute) + " rotated",
+				"api-0 " + at(30*time.Minute) + " current",
+				"api-0 no timestamp",
+				"rpc-0 " + at(10*time.Minute) + " rpc",
+			},
+		},
+		{
+			name: "rotated files are skipped without since",
+			files: []testLogFile{
+				{path: "api/0.log.1", lines: []string{at(20*time.Minute) + " rotated"}},
+				{path: "api/0.log", lines: []string{at(10*time.Minute) + " current"}},
+			},
+			want: []string{"api-0 " + at(10*time.Minute) + " current"},
+		},
+		{
+			name:  "default tail",
+			files: []testLogFile{{path: "api/0.log", lines: numbered(150)}},
+			count: 100,
+		},
+		{
+			name:  "tail 0 shows all",
+			files: []testLogFile{{path: "api/0.log", lines: numbered(150)}},
+			args:  []string{"--tail", "0"},
+			count: 150,
+		},
+		{
+			name: "tail of the merged lines after filtering",
+			files: []testLogFile{
+				{path: "api/0.log", lines: []string{"2024-01-01T10:00:00Z ERROR a", "2024-01-01T10:00:02Z ERROR b", "2024-01-01T10:00:04Z INFO c"}},
+				{path: "rpc/0.log", lines: []string{"2024-01-01T10:00:01Z ERROR d", "2024-01-01T10:00:03Z ERROR e"}},
+			},
+			args: []string{"--tail", "2", "--level", "error"},
+			want: []string{"api-0 2024-01-01T10:00:02Z ERROR b", "rpc-0 2024-01-01T10:00:03Z ERROR e"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestLogs(t, tt.files)
+			_, opts, err := parseLogsArgs(tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paths, err := resolveLogTargets(tt.targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sources := newLogSources(paths, opts)
+			t.Cleanup(func() {
+				for _, src := range sources {
+					if src.file != nil {
+						src.file.Close()
+					}
+				}
+			})
+
+			var got []string
+			err = readLogs(sources, newLogFilter(opts), opts.Tail, func(line *logLine) {
+				got = append(got, line.source.name+" "+line.text)
+			})
+			if err != nil {
+				t.Fatalf("readLogs() error = %v", err)
+			}
+			if tt.count != 0 {
+				if len(got) != tt.count || !strings.HasSuffix(got[len(got)-1], fmt.Sprintf(" line %d", len(tt.files[0].lines))) {
+					t.Errorf("readLogs() showed %d lines ending with %q, want the last %d", len(got), got[len(got)-1], tt.count)
+				}
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readLogs() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
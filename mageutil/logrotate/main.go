@@ -0,0 +1,29 @@
+// Command gomake-logrotate writes the output of instances started by mage to their rotated log files. mage build
+// compiles it next to the service binaries, and mage starts one for the instances it starts together, passing it
+// the read ends of their output pipes.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/openimsdk/gomake/mageutil"
+)
+
+func main() {
+	spec := flag.String("pipes", "[]", "inherited pipes and their log files as JSON")
+	flag.Parse()
+
+	var pipes []mageutil.LogPipe
+	if err := json.Unmarshal([]byte(*spec), &pipes); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -pipes: %v\n", err)
+		os.Exit(2)
+	}
+	// The instances would get SIGPIPE once their output has no reader, so only the end of their output stops it.
+	signal.Ignore(os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
+	mageutil.WriteLogPipes(pipes)
+}
@@ -0,0 +1,381 @@
+package mageutil
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rotatedLogTimeFormat = "20060102-150405"
+
+// LogConfig controls the log files of a service in _output/logs/<service>/<index>.log.
+type LogConfig struct {
+	MaxSize     int           `yaml:"maxSize"`     // Rotate when the file reaches this many megabytes, default 100, -1 disables
+	RotateEvery time.Duration `yaml:"rotateEvery"` // Rotate files older than this, e.g. 24h, 0 disables
+	Compress    bool          `yaml:"compress"`    // Gzip rotated files
+	MaxFiles    int           `yaml:"maxFiles"`    // Rotated files kept per instance, default 10, -1 keeps all
+	MaxAge      time.Duration `yaml:"maxAge"`      // Delete rotated files older than this, 0 keeps them
+}
+
+// withDefaults returns a copy of the config with unset values replaced by their defaults.
+func (c LogConfig) withDefaults() LogConfig {
+	if c.MaxSize == 0 {
+		c.MaxSize = 100
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = 10
+	}
+	return c
+}
+
+var defaultLogConfig LogConfig
+
+// getLogConfig returns the log config of a service or tool, falling back to the top-level logs section.
+func getLogConfig(binary string) LogConfig {
+	if cfg, ok := serviceConfigs[binary]; ok && cfg != nil && cfg.Logs != nil {
+		return cfg.Logs.withDefaults()
+	}
+	return defaultLogConfig.withDefaults()
+}
+
+// instanceLogPath returns the log file of instance index of a service or tool.
+func instanceLogPath(binary string, index int) string {
+	return filepath.Join(Paths.OutputLogs, strings.TrimSuffix(binary, ".exe"), fmt.Sprintf("%d.log", index))
+}
+
+// rotatingWriter appends to a log file and rotates it by size and age.
+type rotatingWriter struct {
+	path   string
+	config LogConfig
+	file   *os.File
+	size   int64
+	opened time.Time
+	mu     sync.Mutex
+	wg     sync.WaitGroup // Pending compressions
+}
+
+func newRotatingWriter(path string, config LogConfig) (*rotatingWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{path: path, config: config}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.opened = time.Now()
+	if w.size > 0 {
+		// Age an existing file from its last write, which is the best estimate available.
+		w.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (w *rotatingWriter) shouldRotate(n int) bool {
+	if w.size == 0 {
+		return false
+	}
+	if w.config.MaxSize > 0 && w.size+int64(n) > int64(w.config.MaxSize)*1024*1024 {
+		return true
+	}
+	return w.config.RotateEvery > 0 && time.Since(w.opened) >= w.config.RotateEvery
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate %s: %v\n", w.path, err)
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file to <name>.<timestamp>, reopens it and applies the retention limits.
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", w.path, time.Now().Format(rotatedLogTimeFormat))
+	for i := 1; fileExists(rotated) || fileExists(rotated+".gz"); i++ {
+		rotated = fmt.Sprintf("%s.%s.%d", w.path, time.Now().Format(rotatedLogTimeFormat), i)
+	}
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	if w.config.Compress {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			if err := gzipFile(rotated); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", rotated, err)
+			}
+			pruneRotatedLogs(w.path, w.config)
+		}()
+		return nil
+	}
+	pruneRotatedLogs(w.path, w.config)
+	return nil
+}
+
+// Close waits for pending compressions and closes the file.
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.wg.Wait()
+	return w.file.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
+// pruneRotatedLogs removes the rotated files of a log beyond MaxFiles or older than MaxAge.
+func pruneRotatedLogs(path string, config LogConfig) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return
+	}
+	type rotatedFile struct {
+		path    string
+		modTime time.Time
+	}
+	var files []rotatedFile
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.Mode().IsRegular() {
+			files = append(files, rotatedFile{match, info.ModTime()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.After(files[j].modTime) })
+	for i, f := range files {
+		tooMany := config.MaxFiles > 0 && i >= config.MaxFiles
+		tooOld := config.MaxAge > 0 && time.Since(f.modTime) > config.MaxAge
+		if tooMany || tooOld {
+			os.Remove(f.path)
+		}
+	}
+}
+
+// logHelperName is the helper that writes the output of instances to their log files. Build compiles it next to the
+// service binaries from the logrotate package.
+const logHelperName = "gomake-logrotate"
+
+// logHelperPath returns the log helper used for the host binaries.
+func logHelperPath() string {
+	return filepath.Join(Paths.OutputHostBin, withExeSuffix(logHelperName))
+}
+
+// buildLogHelper compiles the log helper of this version of mageutil into the binaries of a platform.
+func buildLogHelper(platform string) error {
+	targetOS, targetArch, _ := strings.Cut(platform, "_")
+	output := filepath.Join(Paths.OutputBinPath, targetOS, targetArch, logHelperName)
+	if targetOS == "windows" {
+		output += ".exe"
+	}
+	pkg := reflect.TypeOf(LogConfig{}).PkgPath() + "/logrotate"
+	cmd := exec.Command("go", "build", "-o", output, pkg)
+	cmd.Dir = Paths.Root
+	cmd.Env = append(os.Environ(), "GOOS="+targetOS, "GOARCH="+targetArch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to build %s: %v\n%s", pkg, err, out)
+	}
+	return nil
+}
+
+// LogPipe is the read end of the output pipe of an instance, inherited by the log helper, and the log file it is
+// written to.
+type LogPipe struct {
+	Fd     uintptr
+	Path   string
+	Config LogConfig
+}
+
+// WriteLogPipes writes the output read from each pipe to its log file until every process writing to the pipes
+// exited. It is run by the log helper, see openInstanceLogs.
+func WriteLogPipes(pipes []LogPipe) {
+	var wg sync.WaitGroup
+	for _, pipe := range pipes {
+		wg.Add(1)
+		go func(pipe LogPipe) {
+			defer wg.Done()
+			copyLogPipe(os.NewFile(pipe.Fd, pipe.Path), pipe.Path, pipe.Config)
+		}(pipe)
+	}
+	wg.Wait()
+}
+
+// copyLogPipe drains a pipe into a rotating log file. It keeps reading when the file cannot be written, since the
+// instance would get SIGPIPE once the pipe has no reader.
+func copyLogPipe(pipe *os.File, path string, config LogConfig) {
+	defer pipe.Close()
+	w, err := newRotatingWriter(path, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open %s, discarding its output: %v\n", path, err)
+	} else {
+		defer w.Close()
+	}
+	buf := make([]byte, 32*1024)
+	failing := false
+	for {
+		n, err := pipe.Read(buf)
+		if n > 0 && w != nil {
+			if _, err := w.Write(buf[:n]); err != nil && !failing {
+				fmt.Fprintf(os.Stderr, "failed to write %s: %v\n", path, err)
+			}
+			failing = err != nil
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// instanceLogs are the outputs of instances started together, the write ends of pipes read by one log helper.
+// Without a built helper, or when it fails to start, instances append to their log files directly and the files are
+// not rotated.
+type instanceLogs struct {
+	pipes map[string]*os.File // By instance name, e.g. openim-api[0]
+}
+
+// openInstanceLogs starts a log helper for the selected instances before they are started, so their output always
+// has a reader.
+func openInstanceLogs(instances instanceSelection) *instanceLogs {
+	logs := &instanceLogs{pipes: make(map[string]*os.File)}
+	helper := logHelperPath()
+	if _, err := os.Stat(helper); err != nil {
+		PrintYellow(fmt.Sprintf("%s not found, instance logs are not rotated, run `mage build` to build it", helper))
+		return logs
+	}
+
+	var readers []*os.File
+	var pipes []LogPipe
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	for _, service := range instances.services() {
+		for _, index := range instances.indexes(service) {
+			path := instanceLogPath(service, index)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				PrintYellow(fmt.Sprintf("Failed to create log directory of %s[%d]: %v", service, index, err))
+				continue
+			}
+			r, w, err := os.Pipe()
+			if err != nil {
+				PrintYellow(fmt.Sprintf("Failed to create output pipe of %s[%d]: %v", service, index, err))
+				continue
+			}
+			readers = append(readers, r)
+			logs.pipes[fmt.Sprintf("%s[%d]", service, index)] = w
+			pipes = append(pipes, LogPipe{Path: path, Config: getLogConfig(service)})
+		}
+	}
+	if len(pipes) == 0 {
+		return logs
+	}
+
+	cmd := exec.Command(helper)
+	cmd.Dir = Paths.Root
+	cmd.SysProcAttr = detachedSysProcAttr()
+	for i, fd := range inheritFiles(cmd, readers) {
+		pipes[i].Fd = fd
+	}
+	spec, err := json.Marshal(pipes)
+	if err == nil {
+		cmd.Args = append(cmd.Args, "-pipes", string(spec))
+		if stderr, err := os.OpenFile(filepath.Join(Paths.OutputLogs, logHelperName+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+			defer stderr.Close()
+			cmd.Stderr = stderr
+		}
+		err = cmd.Start()
+	}
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Failed to start %s, instance logs are not rotated: %v", helper, err))
+		logs.Close()
+		return logs
+	}
+	cmd.Process.Release()
+	return logs
+}
+
+// output returns the file instance index of a service writes its output to, the caller closes it once the instance
+// started.
+func (l *instanceLogs) output(service string, index int) (*os.File, error) {
+	name := fmt.Sprintf("%s[%d]", service, index)
+	if w, ok := l.pipes[name]; ok {
+		delete(l.pipes, name)
+		return w, nil
+	}
+	path := instanceLogPath(service, index)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// Close closes the pipes of the instances that were not started, so the helper is not left waiting for them.
+func (l *instanceLogs) Close() {
+	for name, w := range l.pipes {
+		w.Close()
+		delete(l.pipes, name)
+	}
+}
@@ -0,0 +1,89 @@
+package mageutil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// Environment variables marking the processes launched by gomake, they identify the project, service and instance
+// index of a process exactly, unlike its executable path.
+const (
+	ProjectEnv = "GOMAKE_PROJECT"
+	ServiceEnv = "GOMAKE_SERVICE"
+	IndexEnv   = "GOMAKE_INDEX"
+)
+
+// instanceMarker is the identity of an instance read from the environment of its process.
+type instanceMarker struct {
+	service string
+	index   int
+}
+
+// projectID identifies the project tree, so instances of another checkout of the same project are not matched.
+func projectID() string {
+	sum := sha256.Sum256([]byte(Paths.Root))
+	return hex.EncodeToString(sum[:6])
+}
+
+// instanceMarkerEnv returns the marker variables of instance index of a service.
+func instanceMarkerEnv(service string, index int) []string {
+	return []string{ProjectEnv + "=" + projectID(), ServiceEnv + "=" + service, IndexEnv + "=" + strconv.Itoa(index)}
+}
+
+// readInstanceMarker returns the marker of a process of this project, nil when it has none. readable is false when
+// the environment of the process can't be read, e.g. it belongs to another user or the platform doesn't support it.
+func readInstanceMarker(p *process.Process) (marker *instanceMarker, readable bool) {
+	env, err := p.Environ()
+	if err != nil || len(env) == 0 {
+		return nil, false
+	}
+	var project, service, index string
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		switch key {
+		case ProjectEnv:
+			project = value
+		case ServiceEnv:
+			service = value
+		case IndexEnv:
+			index = value
+		}
+	}
+	i, err := strconv.Atoi(index)
+	if project != projectID() || service == "" || err != nil {
+		return nil, true
+	}
+	return &instanceMarker{service: service, index: i}, true
+}
+
+// markedProcesses returns the processes launched by gomake for this project, keyed by service. Processes spawned by
+// an instance inherit its marker, they are skipped while their parent carries the same marker.
+func markedProcesses(processes []*process.Process) (marked map[string][]*process.Process, unreadable []*process.Process) {
+	markers := make(map[int32]*instanceMarker)
+	for _, p := range processes {
+		marker, readable := readInstanceMarker(p)
+		if !readable {
+			unreadable = append(unreadable, p)
+		} else if marker != nil {
+			markers[p.Pid] = marker
+		}
+	}
+	marked = make(map[string][]*process.Process)
+	for _, p := range processes {
+		marker, ok := markers[p.Pid]
+		if !ok {
+			continue
+		}
+		if ppid, err := p.Ppid(); err == nil {
+			if parent, ok := markers[ppid]; ok && *parent == *marker {
+				continue
+			}
+		}
+		marked[marker.service] = append(marked[marker.service], p)
+	}
+	return marked, unreadable
+}
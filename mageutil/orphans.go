@@ -0,0 +1,177 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// deletedExeSuffix is appended by Linux to the executable of a process whose binary was replaced or removed.
+const deletedExeSuffix = " (deleted)"
+
+// strayProcess is a running process that mage check reports.
+type strayProcess struct {
+	service string // Binary name
+	process *process.Process
+	reason  string
+}
+
+func (s strayProcess) String() string {
+	cmdline, _ := s.process.Cmdline()
+	return fmt.Sprintf("%s pid %d (%s): %s", s.service, s.process.Pid, cmdline, s.reason)
+}
+
+// orphanProcesses returns the processes running a binary from the output directories that aren't an expected
+// instance, e.g. services removed from start-config.yml, surplus instances or leftovers of an old tree.
+func orphanProcesses() ([]strayProcess, error) {
+	expected, err := scanServiceProcesses(configuredServices())
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[int32]bool)
+	for _, procs := range expected {
+		for _, p := range procs {
+			known[p.Pid] = true
+		}
+	}
+
+	var roots []string
+	for _, dir := range []string{Paths.Output, Paths.OutputHostBin, Paths.OutputHostBinTools} {
+		if dir, err := filepath.Abs(dir); err == nil && !underDir(dir, roots) {
+			roots = append(roots, dir)
+		}
+	}
+	// The configured directories end with a separator, compare the cleaned absolute path with the binaries' dir.
+	toolsDir, _ := filepath.Abs(Paths.OutputHostBinTools)
+	logHelper, _ := filepath.Abs(logHelperPath())
+
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processes: %v", err)
+	}
+	var orphans []strayProcess
+	for _, p := range processes {
+		if known[p.Pid] || p.Pid == int32(os.Getpid()) {
+			continue
+		}
+		exe, err := p.Exe()
+		if err != nil {
+			continue
+		}
+		exe = strings.TrimSuffix(exe, deletedExeSuffix)
+		if !underDir(exe, roots) || exe == logHelper {
+			continue
+		}
+		service := filepath.Base(exe)
+		reason := "not an instance of start-config.yml"
+		if _, ok := serviceBinaries[service]; ok {
+			reason = "not started by gomake or beyond the configured count"
+		} else if filepath.Dir(exe) == toolsDir {
+			reason = "tool still running"
+		}
+		orphans = append(orphans, strayProcess{service: service, process: p, reason: reason})
+	}
+	sortStrayProcesses(orphans)
+	return orphans, nil
+}
+
+// staleProcesses returns the selected instances whose binary changed after they started.
+func staleProcesses(selection instanceSelection) ([]strayProcess, error) {
+	procs, err := selectedProcesses(selection)
+	if err != nil {
+		return nil, err
+	}
+	var stale []strayProcess
+	for service, list := range procs {
+		binary := GetBinFullPath(service)
+		info, err := os.Stat(binary)
+		if err != nil {
+			continue
+		}
+		for _, p := range list {
+			created, err := p.CreateTime()
+			if err != nil {
+				continue
+			}
+			started := time.UnixMilli(created)
+			if exe, err := p.Exe(); err == nil && strings.HasSuffix(exe, deletedExeSuffix) {
+				stale = append(stale, strayProcess{service: service, process: p, reason: "binary was replaced after the process started"})
+			} else if info.ModTime().After(started) {
+				stale = append(stale, strayProcess{service: service, process: p,
+					reason: fmt.Sprintf("binary built %s, process started %s", info.ModTime().Format(time.DateTime), started.Format(time.DateTime))})
+			}
+		}
+	}
+	sortStrayProcesses(stale)
+	return stale, nil
+}
+
+// reportStrayProcesses prints the stale selected instances found by mage check, and the orphan processes when
+// every instance is checked.
+func reportStrayProcesses(selection instanceSelection) {
+	if selection.complete() {
+		orphans, err := orphanProcesses()
+		if err != nil {
+			PrintYellow(fmt.Sprintf("Failed to look for orphan processes: %v", err))
+		} else if len(orphans) > 0 {
+			PrintYellow("Processes running binaries from the output directory that are not expected, stop them with `mage stop --orphans`:")
+			for _, o := range orphans {
+				PrintYellow("  " + o.String())
+			}
+		}
+	}
+
+	stale, err := staleProcesses(selection)
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Failed to look for stale instances: %v", err))
+	} else if len(stale) > 0 {
+		PrintYellow("Instances running stale code, restart them with `mage restart`:")
+		for _, s := range stale {
+			PrintYellow("  " + s.String())
+		}
+	}
+}
+
+// StopOrphans stops the orphan processes reported by mage check.
+func StopOrphans() error {
+	orphans, err := orphanProcesses()
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		PrintGreen("No orphan processes found")
+		return nil
+	}
+	procs := make(map[string][]*process.Process)
+	for _, o := range orphans {
+		PrintBlue("Stopping " + o.String())
+		procs[o.service] = append(procs[o.service], o.process)
+	}
+	stopServiceProcesses(procs)
+	PrintGreen(fmt.Sprintf("Stopped %d orphan processes", len(orphans)))
+	return nil
+}
+
+// underDir reports whether path is one of dirs or inside one of them.
+func underDir(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if rel, err := filepath.Rel(dir, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortStrayProcesses(list []strayProcess) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].service != list[j].service {
+			return list[i].service < list[j].service
+		}
+		return list[i].process.Pid < list[j].process.Pid
+	})
+}
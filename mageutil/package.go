@@ -0,0 +1,489 @@
+package mageutil
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const PackagesDir = "packages"
+
+// PackageConfig describes the .deb and .rpm packages built by `mage deb` and `mage rpm`.
+type PackageConfig struct {
+	Name        string   `yaml:"name"`
+	Prefix      string   `yaml:"prefix"` // Installation prefix, default /opt/<name>
+	Release     string   `yaml:"release"`
+	Maintainer  string   `yaml:"maintainer"`
+	Vendor      string   `yaml:"vendor"`
+	Summary     string   `yaml:"summary"`
+	Description string   `yaml:"description"`
+	Homepage    string   `yaml:"homepage"`
+	License     string   `yaml:"license"`
+	Conffiles   []string `yaml:"conffiles"` // Extra paths, relative to the prefix, treated as config files
+	Deb         struct {
+		Depends  []string `yaml:"depends"` // Debian syntax, e.g. "libc6 (>= 2.17)"
+		Section  string   `yaml:"section"`
+		Priority string   `yaml:"priority"`
+	} `yaml:"deb"`
+	Rpm struct {
+		Requires []string `yaml:"requires"` // e.g. "glibc >= 2.17"
+		Group    string   `yaml:"group"`
+	} `yaml:"rpm"`
+}
+
+var packageConfig PackageConfig
+
+// packageFile is a file or directory placed on the target system by a package.
+type packageFile struct {
+	Path     string // Absolute path on the target system
+	Dir      bool
+	Mode     os.FileMode // Permission bits
+	Data     []byte
+	Conffile bool
+}
+
+type packageSpec struct {
+	Name        string
+	Version     string
+	Release     string
+	GOOS        string
+	GOARCH      string
+	Prefix      string
+	Maintainer  string
+	Vendor      string
+	Summary     string
+	Description string
+	Homepage    string
+	License     string
+	BuildTime   time.Time
+	Files       []packageFile
+	PostInstall string
+	PreRemove   string
+	PostRemove  string
+}
+
+// installedSize returns the total size of the packaged files in bytes.
+func (s *packageSpec) installedSize() int64 {
+	var size int64
+	for _, f := range s.Files {
+		size += int64(len(f.Data))
+	}
+	return size
+}
+
+const packageScript = `if command -v systemctl >/dev/null 2>&1; then
+  systemctl daemon-reload >/dev/null 2>&1 || true
+fi
+`
+
+// packagePreRemoveScript stops the instances of every service and disables the configured ones when the package is
+// removed. Upgrades leave them running, dpkg passes remove to prerm and rpm passes 0 to %preun on removal only.
+func packagePreRemoveScript(name string) string {
+	var script strings.Builder
+	script.WriteString(`if [ "$1" = remove ] || [ "$1" = 0 ]; then` + "\n")
+	script.WriteString("  if command -v systemctl >/dev/null 2>&1; then\n")
+	for _, binary := range configuredServices() {
+		unitName := fmt.Sprintf("%s-%s@", name, binary)
+		// The pattern also matches instances started beyond the configured count.
+		fmt.Fprintf(&script, "    systemctl stop '%s*.service' >/dev/null 2>&1 || true\n", unitName)
+		var units []string
+		for index := 0; index < serviceBinaries[binary]; index++ {
+			units = append(units, fmt.Sprintf("%s%d.service", unitName, index))
+		}
+		if len(units) > 0 {
+			fmt.Fprintf(&script, "    systemctl disable %s >/dev/null 2>&1 || true\n", strings.Join(units, " "))
+		}
+	}
+	script.WriteString("  fi\nfi\n")
+	return script.String()
+}
+
+// Package builds a .deb or .rpm package for the host or the platform given with --platform.
+func Package(format string, args []string) {
+	flags := newFlagSet(format)
+	platform := flags.String("platform", DetectPlatform(), "target platform, e.g. linux_arm64")
+	version := flags.String("version", "", "package version, default derived from git describe")
+	if rest, err := parseArgs(flags, args); err != nil || len(rest) > 0 {
+		if err == nil {
+			err = fmt.Errorf("unexpected arguments: %v", rest)
+		}
+		PrintRed(fmt.Sprintf("Invalid %s arguments: %v", format, err))
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	unitDir := "/lib/systemd/system"
+	if format == "rpm" {
+		unitDir = "/usr/lib/systemd/system"
+	}
+	spec, err := newPackageSpec(*platform, *version, unitDir)
+	if err != nil {
+		PrintRed("Failed to prepare package: " + err.Error())
+		os.Exit(1)
+	}
+
+	outputDir := filepath.Join(Paths.Output, PackagesDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		PrintRed(fmt.Sprintf("Failed to create directory %s: %v", outputDir, err))
+		os.Exit(1)
+	}
+
+	var output string
+	switch format {
+	case "deb":
+		output, err = writeDeb(spec, outputDir)
+	case "rpm":
+		output, err = writeRpm(spec, outputDir)
+	default:
+		err = fmt.Errorf("unsupported package format %s", format)
+	}
+	if err != nil {
+		PrintRed(fmt.Sprintf("Failed to build %s package: %v", format, err))
+		os.Exit(1)
+	}
+	PrintGreen(fmt.Sprintf("Package written to %s", output))
+}
+
+// newPackageSpec collects the binaries, tools, config files and systemd units, placed in unitDir, for the given platform.
+func newPackageSpec(platform, version, unitDir string) (*packageSpec, error) {
+	parts := strings.Split(platform, "_")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid platform %q, expected os_arch", platform)
+	}
+	goos, goarch := parts[0], parts[1]
+	if goos != "linux" {
+		return nil, fmt.Errorf("packages can only be built for linux, got %s", goos)
+	}
+
+	cfg := packageConfig
+	if cfg.Name == "" {
+		cfg.Name = filepath.Base(filepath.Clean(Paths.Root))
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "/opt/" + cfg.Name
+	}
+	if !path.IsAbs(cfg.Prefix) {
+		return nil, fmt.Errorf("package prefix must be an absolute path: %s", cfg.Prefix)
+	}
+	if cfg.Release == "" {
+		cfg.Release = "1"
+	}
+	if cfg.Maintainer == "" {
+		cfg.Maintainer = "unknown <unknown@localhost>"
+	}
+	if cfg.Summary == "" {
+		cfg.Summary = cfg.Name + " services"
+	}
+	if cfg.License == "" {
+		cfg.License = "Proprietary"
+	}
+
+	if version == "" {
+		var err error
+		if version, err = gitVersion(); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := &packageSpec{
+		Name:        cfg.Name,
+		Version:     version,
+		Release:     cfg.Release,
+		GOOS:        goos,
+		GOARCH:      goarch,
+		Prefix:      path.Clean(cfg.Prefix),
+		Maintainer:  cfg.Maintainer,
+		Vendor:      cfg.Vendor,
+		Summary:     cfg.Summary,
+		Description: cfg.Description,
+		Homepage:    cfg.Homepage,
+		License:     cfg.License,
+		BuildTime:   time.Now(),
+		PostInstall: packageScript,
+		PreRemove:   packagePreRemoveScript(cfg.Name),
+		PostRemove:  packageScript,
+	}
+
+	conffiles := make(map[string]bool)
+	for _, f := range cfg.Conffiles {
+		conffiles[path.Join(spec.Prefix, filepath.ToSlash(f))] = true
+	}
+	add := func(f packageFile) {
+		if !f.Dir && (conffiles[f.Path] || strings.HasPrefix(f.Path, path.Join(spec.Prefix, installEtcDir)+"/")) {
+			f.Conffile = true
+		}
+		spec.Files = append(spec.Files, f)
+	}
+	addDir := func(rel string) {
+		add(packageFile{Path: path.Join(spec.Prefix, filepath.ToSlash(rel)), Dir: true, Mode: 0755})
+	}
+	addTree := func(srcDir, rel string) error {
+		return filepath.Walk(srcDir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			sub, err := filepath.Rel(srcDir, p)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(rel, sub)
+			if info.IsDir() {
+				addDir(target)
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			add(packageFile{Path: path.Join(spec.Prefix, filepath.ToSlash(target)), Mode: info.Mode().Perm(), Data: data})
+			return nil
+		})
+	}
+
+	addDir(".")
+	binDir := filepath.Join(Paths.OutputBinPath, goos, goarch)
+	toolsDir := filepath.Join(Paths.OutputBinToolPath, goos, goarch)
+	if countBinaries(mustListRegularFiles(binDir)) == 0 && countBinaries(mustListRegularFiles(toolsDir)) == 0 {
+		return nil, fmt.Errorf("no binaries found for %s, please build first with PLATFORMS=%s", platform, platform)
+	}
+	addDir(installBinDir)
+	for _, name := range mustListRegularFiles(binDir) {
+		data, err := os.ReadFile(filepath.Join(binDir, name))
+		if err != nil {
+			return nil, err
+		}
+		mode := os.FileMode(0755)
+		if name == BinaryManifestFile || name == BinaryManifestSigFile {
+			mode = 0644
+		}
+		add(packageFile{Path: path.Join(spec.Prefix, installBinDir, name), Mode: mode, Data: data})
+	}
+	if _, err := os.Stat(toolsDir); err == nil {
+		if err := addTree(toolsDir, installToolsDir); err != nil {
+			return nil, err
+		}
+	}
+
+	addDir(installEtcDir)
+	if _, err := os.Stat(Paths.Config); err == nil {
+		if err := addTree(Paths.Config, installConfigDir); err != nil {
+			return nil, err
+		}
+	}
+	startConfig, err := installedStartConfig(spec.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	add(packageFile{Path: path.Join(spec.Prefix, installEtcDir, StartConfigFile), Mode: 0644, Data: startConfig})
+
+	addDir("var")
+	addDir(installLogDir)
+	addDir(installTmpDir)
+
+	units, err := systemdUnits(spec, unitDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, unit := range units {
+		add(unit)
+	}
+
+	sort.SliceStable(spec.Files, func(i, j int) bool { return spec.Files[i].Path < spec.Files[j].Path })
+	return spec, nil
+}
+
+func mustListRegularFiles(dir string) []string {
+	names, err := listRegularFiles(dir)
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Failed to read directory %s: %v", dir, err))
+	}
+	return names
+}
+
+// systemdUnits generates a template unit per service, so instance n is started with `systemctl start <name>-<service>@n`.
+// The template carries the restart, stop and limit settings of the service. The command line, environment and working
+// directory are rendered per instance from the service templates into a drop-in of each configured instance.
+func systemdUnits(spec *packageSpec, unitDir string) ([]packageFile, error) {
+	names := make([]string, 0, len(serviceBinaries))
+	for binary := range serviceBinaries {
+		names = append(names, binary)
+	}
+	sort.Strings(names)
+
+	var units []packageFile
+	for _, binary := range names {
+		cfg := getServiceConfig(binary)
+		if cfg.Port.Auto {
+			return nil, fmt.Errorf("%s picks its port automatically, which systemd units can't do, configure fixed ports to package it", binary)
+		}
+		if cfg.Stop.PreStop != nil || cfg.Probes.Readiness != nil || cfg.Probes.Liveness != nil {
+			PrintYellow(fmt.Sprintf("The probes and preStop hook of %s are not used by its systemd unit", binary))
+		}
+		unitName := fmt.Sprintf("%s-%s@", spec.Name, binary)
+
+		var unit strings.Builder
+		fmt.Fprintf(&unit, "[Unit]\n")
+		fmt.Fprintf(&unit, "Description=%s %s instance %%i\n", spec.Name, binary)
+		fmt.Fprintf(&unit, "After=network.target\n\n")
+		fmt.Fprintf(&unit, "[Service]\n")
+		fmt.Fprintf(&unit, "Type=simple\n")
+		fmt.Fprintf(&unit, "Restart=%s\n", systemdRestart(cfg.Restart.Policy))
+		fmt.Fprintf(&unit, "RestartSec=%g\n", cfg.Restart.Backoff.Seconds())
+		fmt.Fprintf(&unit, "KillSignal=%s\n", cfg.Stop.Signal)
+		fmt.Fprintf(&unit, "TimeoutStopSec=%g\n", cfg.Stop.Timeout.Seconds())
+		writeSystemdLimits(&unit, cfg.Limits)
+		fmt.Fprintf(&unit, "\n[Install]\n")
+		fmt.Fprintf(&unit, "WantedBy=multi-user.target\n")
+		units = append(units, packageFile{
+			Path: path.Join(unitDir, unitName+".service"),
+			Mode: 0644,
+			Data: []byte(unit.String()),
+		})
+
+		for index := 0; index < serviceBinaries[binary]; index++ {
+			dropIn, err := systemdInstanceDropIn(spec, binary, index, cfg)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %v", binary, index, err)
+			}
+			dir := path.Join(unitDir, fmt.Sprintf("%s%d.service.d", unitName, index))
+			units = append(units,
+				packageFile{Path: dir, Dir: true, Mode: 0755},
+				packageFile{Path: path.Join(dir, "instance.conf"), Mode: 0644, Data: dropIn},
+			)
+		}
+	}
+	return units, nil
+}
+
+// systemdInstanceDropIn renders the command line, environment and working directory of an instance for the
+// installed tree.
+func systemdInstanceDropIn(spec *packageSpec, binary string, index int, cfg ServiceConfig) ([]byte, error) {
+	port, err := cfg.Port.fixedPort(index)
+	if err != nil {
+		return nil, err
+	}
+	launch, err := cfg.launchSpec(InstanceTemplateData{
+		Service:   strings.TrimSuffix(binary, ".exe"),
+		Index:     index,
+		ConfigDir: path.Join(spec.Prefix, installConfigDir) + "/",
+		Port:      port,
+		Root:      spec.Prefix,
+		binDir:    path.Join(spec.Prefix, installBinDir),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var dropIn strings.Builder
+	fmt.Fprintf(&dropIn, "[Service]\n")
+	fmt.Fprintf(&dropIn, "WorkingDirectory=%s\n", systemdEscape(filepath.ToSlash(launch.Dir)))
+	for _, env := range launch.Env {
+		fmt.Fprintf(&dropIn, "Environment=%s\n", systemdQuote(env))
+	}
+	args := []string{systemdQuote(path.Join(spec.Prefix, installBinDir, binary))}
+	for _, arg := range launch.Args {
+		args = append(args, systemdQuote(arg))
+	}
+	fmt.Fprintf(&dropIn, "ExecStart=%s\n", strings.Join(args, " "))
+	return []byte(dropIn.String()), nil
+}
+
+// systemdRestart maps a restart policy to the Restart= setting.
+func systemdRestart(policy string) string {
+	if policy == RestartNever {
+		return "no"
+	}
+	return policy
+}
+
+// writeSystemdLimits writes the resource limits of a service as the matching systemd settings.
+func writeSystemdLimits(unit *strings.Builder, limits LimitsConfig) {
+	value := func(v LimitValue) string {
+		if v == Unlimited {
+			return "infinity"
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	if limits.OpenFiles != nil {
+		fmt.Fprintf(unit, "LimitNOFILE=%s\n", value(*limits.OpenFiles))
+	} else if MaxFileDescriptors > 0 {
+		fmt.Fprintf(unit, "LimitNOFILE=%d\n", MaxFileDescriptors)
+	}
+	for _, limit := range []struct {
+		name  string
+		value *LimitValue
+	}{
+		{"LimitCORE", limits.CoreSize},
+		{"LimitAS", limits.AddressSpace},
+		{"LimitNPROC", limits.Processes},
+		{"MemoryMax", limits.Memory},
+	} {
+		if limit.value != nil {
+			fmt.Fprintf(unit, "%s=%s\n", limit.name, value(*limit.value))
+		}
+	}
+	if limits.CPU > 0 {
+		fmt.Fprintf(unit, "CPUQuota=%d%%\n", int(math.Round(limits.CPU*100)))
+	}
+}
+
+// systemdEscape escapes the specifiers and variable references systemd expands in unit settings.
+func systemdEscape(s string) string {
+	return strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+}
+
+// systemdQuote escapes a word of ExecStart= or Environment=, quoting it when it contains blanks or quotes.
+func systemdQuote(s string) string {
+	s = systemdEscape(s)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+var invalidVersionChars = regexp.MustCompile(`[^A-Za-z0-9.+~]`)
+
+// gitVersion derives a package version from `git describe`, e.g. v1.2.3-4-gabcdef becomes 1.2.3+4.gabcdef. An
+// untagged repository gets 0.0.0+git<commit date>.<hash>, so versions of later commits still sort higher.
+func gitVersion() (string, error) {
+	out, err := exec.Command("git", "-C", Paths.Root, "describe", "--tags", "--dirty").Output()
+	if err != nil {
+		return untaggedGitVersion()
+	}
+	version := strings.TrimPrefix(strings.TrimSpace(string(out)), "v")
+	if idx := strings.Index(version, "-"); idx >= 0 {
+		version = version[:idx] + "+" + strings.ReplaceAll(version[idx+1:], "-", ".")
+	}
+	version = invalidVersionChars.ReplaceAllString(version, ".")
+	// Versions must start with a digit, tags like release-1 are kept as build metadata.
+	if version == "" || version[0] < '0' || version[0] > '9' {
+		version = "0.0.0+" + version
+	}
+	return version, nil
+}
+
+// untaggedGitVersion derives the version of a repository without tags from the date and hash of HEAD.
+func untaggedGitVersion() (string, error) {
+	cmd := exec.Command("git", "-C", Paths.Root, "log", "-1", "--format=%cd.%h", "--date=format-local:%Y%m%d%H%M%S")
+	cmd.Env = append(os.Environ(), "TZ=UTC")
+	out, err := cmd.Output()
+	if err != nil || len(strings.TrimSpace(string(out))) == 0 {
+		return "", fmt.Errorf("failed to derive version from git, use --version: %v", err)
+	}
+	version := "0.0.0+git" + strings.TrimSpace(string(out))
+	if err := exec.Command("git", "-C", Paths.Root, "diff", "--quiet", "HEAD").Run(); err != nil {
+		version += ".dirty"
+	}
+	return invalidVersionChars.ReplaceAllString(version, "."), nil
+}
@@ -0,0 +1,187 @@
+package mageutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var debArchMap = map[string]string{
+	"amd64":   "amd64",
+	"arm64":   "arm64",
+	"386":     "i386",
+	"arm":     "armhf",
+	"ppc64le": "ppc64el",
+	"s390x":   "s390x",
+}
+
+// writeDeb writes spec as a Debian binary package to outputDir and returns its path.
+func writeDeb(spec *packageSpec, outputDir string) (string, error) {
+	arch, ok := debArchMap[spec.GOARCH]
+	if !ok {
+		arch = spec.GOARCH
+	}
+
+	data, err := debDataArchive(spec)
+	if err != nil {
+		return "", err
+	}
+	control, err := debControlArchive(spec, arch)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	mtime := spec.BuildTime.Unix()
+	for _, member := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", control},
+		{"data.tar.gz", data},
+	} {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, mtime, 0, 0, "100644", len(member.data))
+		buf.Write(member.data)
+		if len(member.data)%2 != 0 {
+			buf.WriteByte('\n')
+		}
+	}
+
+	output := filepath.Join(outputDir, fmt.Sprintf("%s_%s-%s_%s.deb", spec.Name, spec.Version, spec.Release, arch))
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+func debControlArchive(spec *packageSpec, arch string) ([]byte, error) {
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\n", spec.Name)
+	fmt.Fprintf(&control, "Version: %s-%s\n", spec.Version, spec.Release)
+	fmt.Fprintf(&control, "Architecture: %s\n", arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", spec.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (spec.installedSize()+1023)/1024)
+	if len(packageConfig.Deb.Depends) > 0 {
+		fmt.Fprintf(&control, "Depends: %s\n", strings.Join(packageConfig.Deb.Depends, ", "))
+	}
+	section, priority := packageConfig.Deb.Section, packageConfig.Deb.Priority
+	if section == "" {
+		section = "misc"
+	}
+	if priority == "" {
+		priority = "optional"
+	}
+	fmt.Fprintf(&control, "Section: %s\n", section)
+	fmt.Fprintf(&control, "Priority: %s\n", priority)
+	if spec.Homepage != "" {
+		fmt.Fprintf(&control, "Homepage: %s\n", spec.Homepage)
+	}
+	fmt.Fprintf(&control, "Description: %s\n", spec.Summary)
+	for _, line := range strings.Split(strings.TrimSpace(spec.Description), "\n") {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			if spec.Description != "" {
+				control.WriteString(" .\n")
+			}
+			continue
+		}
+		fmt.Fprintf(&control, " %s\n", line)
+	}
+
+	var conffiles, md5sums strings.Builder
+	for _, f := range spec.Files {
+		if f.Dir {
+			continue
+		}
+		sum := md5.Sum(f.Data)
+		fmt.Fprintf(&md5sums, "%s  %s\n", hex.EncodeToString(sum[:]), strings.TrimPrefix(f.Path, "/"))
+		if f.Conffile {
+			fmt.Fprintf(&conffiles, "%s\n", f.Path)
+		}
+	}
+
+	files := []packageFile{
+		{Path: "./control", Mode: 0644, Data: []byte(control.String())},
+		{Path: "./md5sums", Mode: 0644, Data: []byte(md5sums.String())},
+		{Path: "./postinst", Mode: 0755, Data: []byte("#!/bin/sh\nset -e\n" + spec.PostInstall)},
+		{Path: "./prerm", Mode: 0755, Data: []byte("#!/bin/sh\nset -e\n" + spec.PreRemove)},
+		{Path: "./postrm", Mode: 0755, Data: []byte("#!/bin/sh\nset -e\n" + spec.PostRemove)},
+	}
+	if conffiles.Len() > 0 {
+		files = append(files, packageFile{Path: "./conffiles", Mode: 0644, Data: []byte(conffiles.String())})
+	}
+	return tarGz(files, spec)
+}
+
+// debDataArchive returns the data.tar.gz member, adding the parent directories of every file.
+func debDataArchive(spec *packageSpec) ([]byte, error) {
+	seen := make(map[string]bool)
+	var files []packageFile
+	var addParents func(dir string)
+	addParents = func(dir string) {
+		if dir == "/" || seen[dir] {
+			return
+		}
+		addParents(path.Dir(dir))
+		seen[dir] = true
+		files = append(files, packageFile{Path: "." + dir + "/", Dir: true, Mode: 0755})
+	}
+
+	files = append(files, packageFile{Path: "./", Dir: true, Mode: 0755})
+	for _, f := range spec.Files {
+		if f.Dir {
+			addParents(f.Path)
+			continue
+		}
+		addParents(path.Dir(f.Path))
+		f.Path = "." + f.Path
+		files = append(files, f)
+	}
+	return tarGz(files, spec)
+}
+
+func tarGz(files []packageFile, spec *packageSpec) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:    f.Path,
+			Mode:    int64(f.Mode.Perm()),
+			ModTime: spec.BuildTime,
+			Uname:   "root",
+			Gname:   "root",
+			Format:  tar.FormatGNU,
+		}
+		if f.Dir {
+			hdr.Typeflag = tar.TypeDir
+		} else {
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(f.Data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if !f.Dir {
+			if _, err := tw.Write(f.Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
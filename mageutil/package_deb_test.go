@@ -0,0 +1,77 @@
+package mageutil
+
+import (
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestWriteDeb checks the package with dpkg-deb, the test is skipped where it is not installed.
+func TestWriteDeb(t *testing.T) {
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		t.Skip("dpkg-deb is not installed")
+	}
+	depends := packageConfig.Deb.Depends
+	t.Cleanup(func() { packageConfig.Deb.Depends = depends })
+	packageConfig.Deb.Depends = []string{"libc6 (>= 2.17)", "bash"}
+
+	spec := testPackageSpec()
+	spec.Maintainer = "Gomake <gomake@example.com>"
+	spec.Description = "First paragraph.\n\nSecond paragraph."
+	dir := t.TempDir()
+	output, err := writeDeb(spec, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "gomake-test_1.2.3+4.gabcdef-1_amd64.deb"); output != want {
+		t.Errorf("output = %s, want %s", output, want)
+	}
+
+	dpkgDeb := func(option string, args ...string) string {
+		t.Helper()
+		out, err := exec.Command("dpkg-deb", append([]string{option, output}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("dpkg-deb %s: %v\n%s", option, err, out)
+		}
+		return string(out)
+	}
+
+	fields := map[string]string{
+		"Package":      "gomake-test",
+		"Version":      "1.2.3+4.gabcdef-1",
+		"Architecture": "amd64",
+		"Depends":      "libc6 (>= 2.17), bash",
+		"Description":  "Test package\n First paragraph.\n .\n Second paragraph.",
+	}
+	for field, want := range fields {
+		if got := strings.TrimSuffix(dpkgDeb("--field", field), "\n"); got != want {
+			t.Errorf("%s = %q, want %q", field, got, want)
+		}
+	}
+	if got := dpkgDeb("--info", "conffiles"); got != "/opt/gomake-test/etc/config.yml\n" {
+		t.Errorf("conffiles = %q", got)
+	}
+	if got, want := dpkgDeb("--info", "prerm"), "#!/bin/sh\nset -e\n"+spec.PreRemove; got != want {
+		t.Errorf("prerm = %q, want %q", got, want)
+	}
+
+	var files []string
+	for _, line := range strings.Split(strings.TrimSpace(dpkgDeb("--contents")), "\n") {
+		fields := strings.Fields(line)
+		files = append(files, fields[0]+" "+fields[len(fields)-1])
+	}
+	want := []string{
+		"drwxr-xr-x ./",
+		"drwxr-xr-x ./opt/",
+		"drwxr-xr-x ./opt/gomake-test/",
+		"drwxr-xr-x ./opt/gomake-test/bin/",
+		"-rwxr-xr-x ./opt/gomake-test/bin/api",
+		"drwxr-xr-x ./opt/gomake-test/etc/",
+		"-rw-r--r-- ./opt/gomake-test/etc/config.yml",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("contents = %q, want %q", files, want)
+	}
+}
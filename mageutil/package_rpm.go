@@ -0,0 +1,445 @@
+package mageutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var rpmArchMap = map[string]string{
+	"amd64":   "x86_64",
+	"arm64":   "aarch64",
+	"386":     "i386",
+	"arm":     "armv7hl",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+}
+
+// RPM header data types.
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+// RPM header and signature tags, see rpmtag.h.
+const (
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagName             = 1000
+	rpmTagVersion          = 1001
+	rpmTagRelease          = 1002
+	rpmTagSummary          = 1004
+	rpmTagDescription      = 1005
+	rpmTagBuildTime        = 1006
+	rpmTagBuildHost        = 1007
+	rpmTagSize             = 1009
+	rpmTagVendor           = 1011
+	rpmTagLicense          = 1014
+	rpmTagPackager         = 1015
+	rpmTagGroup            = 1016
+	rpmTagURL              = 1020
+	rpmTagOS               = 1021
+	rpmTagArch             = 1022
+	rpmTagPostIn           = 1024
+	rpmTagPreUn            = 1025
+	rpmTagPostUn           = 1026
+	rpmTagFileSizes        = 1028
+	rpmTagFileModes        = 1030
+	rpmTagFileRdevs        = 1033
+	rpmTagFileMtimes       = 1034
+	rpmTagFileDigests      = 1035
+	rpmTagFileLinkTos      = 1036
+	rpmTagFileFlags        = 1037
+	rpmTagFileUserName     = 1039
+	rpmTagFileGroupName    = 1040
+	rpmTagSourceRpm        = 1044
+	rpmTagFileVerifyFlags  = 1045
+	rpmTagProvideName      = 1047
+	rpmTagRequireFlags     = 1048
+	rpmTagRequireName      = 1049
+	rpmTagRequireVersion   = 1050
+	rpmTagRpmVersion       = 1064
+	rpmTagPostInProg       = 1086
+	rpmTagPreUnProg        = 1087
+	rpmTagPostUnProg       = 1088
+	rpmTagFileDevices      = 1095
+	rpmTagFileInodes       = 1096
+	rpmTagFileLangs        = 1097
+	rpmTagProvideFlags     = 1112
+	rpmTagProvideVersion   = 1113
+	rpmTagDirIndexes       = 1116
+	rpmTagBaseNames        = 1117
+	rpmTagDirNames         = 1118
+	rpmTagPayloadFormat    = 1124
+	rpmTagPayloadCompress  = 1125
+	rpmTagPayloadFlags     = 1126
+	rpmTagFileDigestAlgo   = 5011
+
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+)
+
+const (
+	rpmFileConfig    = 1 << 0
+	rpmFileNoReplace = 1 << 4
+
+	rpmSenseLess    = 1 << 1
+	rpmSenseGreater = 1 << 2
+	rpmSenseEqual   = 1 << 3
+
+	rpmDigestAlgoSHA256 = 8
+)
+
+type rpmEntry struct {
+	tag   int32
+	typ   int32
+	count int32
+	data  []byte
+}
+
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) add(tag, typ int32, count int, data []byte) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, typ: typ, count: int32(count), data: data})
+}
+
+func (h *rpmHeader) addString(tag int32, s string) {
+	h.add(tag, rpmTypeString, 1, append([]byte(s), 0))
+}
+
+func (h *rpmHeader) addI18NString(tag int32, s string) {
+	h.add(tag, rpmTypeI18NString, 1, append([]byte(s), 0))
+}
+
+func (h *rpmHeader) addStringArray(tag int32, values []string) {
+	var buf bytes.Buffer
+	for _, v := range values {
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	}
+	h.add(tag, rpmTypeStringArray, len(values), buf.Bytes())
+}
+
+func (h *rpmHeader) addInt32(tag int32, values ...int32) {
+	buf := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(buf[4*i:], uint32(v))
+	}
+	h.add(tag, rpmTypeInt32, len(values), buf)
+}
+
+func (h *rpmHeader) addInt16(tag int32, values ...uint16) {
+	buf := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(buf[2*i:], v)
+	}
+	h.add(tag, rpmTypeInt16, len(values), buf)
+}
+
+func (h *rpmHeader) addBin(tag int32, data []byte) {
+	h.add(tag, rpmTypeBin, len(data), data)
+}
+
+// bytes serializes the header with an immutable region tag, as rpm expects from package headers.
+func (h *rpmHeader) bytes(regionTag int32) []byte {
+	entries := append([]rpmEntry(nil), h.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	var store bytes.Buffer
+	index := make([][4]int32, 0, len(entries)+1)
+	for _, e := range entries {
+		align := 1
+		switch e.typ {
+		case rpmTypeInt16:
+			align = 2
+		case rpmTypeInt32:
+			align = 4
+		}
+		for store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		index = append(index, [4]int32{e.tag, e.typ, int32(store.Len()), e.count})
+		store.Write(e.data)
+	}
+
+	nindex := int32(len(entries) + 1)
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint32(trailer[0:], uint32(regionTag))
+	binary.BigEndian.PutUint32(trailer[4:], rpmTypeBin)
+	binary.BigEndian.PutUint32(trailer[8:], uint32(-nindex*16))
+	binary.BigEndian.PutUint32(trailer[12:], 16)
+	region := [4]int32{regionTag, rpmTypeBin, int32(store.Len()), 16}
+	store.Write(trailer)
+
+	var buf bytes.Buffer
+	buf.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&buf, binary.BigEndian, nindex)
+	binary.Write(&buf, binary.BigEndian, int32(store.Len()))
+	for _, entry := range append([][4]int32{region}, index...) {
+		binary.Write(&buf, binary.BigEndian, entry)
+	}
+	buf.Write(store.Bytes())
+	return buf.Bytes()
+}
+
+// writeRpm writes spec as a binary RPM package (format version 3 lead, gzip compressed cpio payload) to outputDir.
+func writeRpm(spec *packageSpec, outputDir string) (string, error) {
+	arch, ok := rpmArchMap[spec.GOARCH]
+	if !ok {
+		arch = spec.GOARCH
+	}
+	nvr := fmt.Sprintf("%s-%s-%s", spec.Name, spec.Version, spec.Release)
+
+	payload, payloadSize, err := rpmPayload(spec)
+	if err != nil {
+		return "", err
+	}
+	header := rpmMainHeader(spec, arch).bytes(rpmTagHeaderImmutable)
+
+	md5sum := md5.New()
+	md5sum.Write(header)
+	md5sum.Write(payload)
+	sha1sum := sha1.Sum(header)
+	sha256sum := sha256.Sum256(header)
+	sig := &rpmHeader{}
+	sig.addString(rpmSigTagSHA1, hex.EncodeToString(sha1sum[:]))
+	sig.addString(rpmSigTagSHA256, hex.EncodeToString(sha256sum[:]))
+	sig.addInt32(rpmSigTagSize, int32(len(header)+len(payload)))
+	sig.addBin(rpmSigTagMD5, md5sum.Sum(nil))
+	sig.addInt32(rpmSigTagPayloadSize, int32(payloadSize))
+	sigBytes := sig.bytes(rpmTagHeaderSignatures)
+
+	var buf bytes.Buffer
+	// Lead: magic, version 3.0, binary package, arch, name, os linux, header-style signature.
+	lead := make([]byte, 96)
+	copy(lead[0:], []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[6:], 0)
+	binary.BigEndian.PutUint16(lead[8:], 1)
+	name := nvr
+	if len(name) > 65 {
+		name = name[:65]
+	}
+	copy(lead[10:76], name)
+	binary.BigEndian.PutUint16(lead[76:], 1)
+	binary.BigEndian.PutUint16(lead[78:], 5)
+	buf.Write(lead)
+	buf.Write(sigBytes)
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+	buf.Write(header)
+	buf.Write(payload)
+
+	output := filepath.Join(outputDir, fmt.Sprintf("%s.%s.rpm", nvr, arch))
+	if err := os.WriteFile(output, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+func rpmMainHeader(spec *packageSpec, arch string) *rpmHeader {
+	h := &rpmHeader{}
+	h.addString(rpmTagName, spec.Name)
+	h.addString(rpmTagVersion, spec.Version)
+	h.addString(rpmTagRelease, spec.Release)
+	h.addI18NString(rpmTagSummary, spec.Summary)
+	description := spec.Description
+	if description == "" {
+		description = spec.Summary
+	}
+	h.addI18NString(rpmTagDescription, description)
+	h.addInt32(rpmTagBuildTime, int32(spec.BuildTime.Unix()))
+	host, _ := os.Hostname()
+	h.addString(rpmTagBuildHost, host)
+	h.addInt32(rpmTagSize, int32(spec.installedSize()))
+	if spec.Vendor != "" {
+		h.addString(rpmTagVendor, spec.Vendor)
+	}
+	h.addString(rpmTagLicense, spec.License)
+	h.addString(rpmTagPackager, spec.Maintainer)
+	group := packageConfig.Rpm.Group
+	if group == "" {
+		group = "Unspecified"
+	}
+	h.addI18NString(rpmTagGroup, group)
+	if spec.Homepage != "" {
+		h.addString(rpmTagURL, spec.Homepage)
+	}
+	h.addString(rpmTagOS, "linux")
+	h.addString(rpmTagArch, arch)
+	h.addString(rpmTagSourceRpm, fmt.Sprintf("%s-%s-%s.src.rpm", spec.Name, spec.Version, spec.Release))
+	h.addString(rpmTagRpmVersion, "4.16.0")
+	h.addString(rpmTagPostIn, spec.PostInstall)
+	h.addString(rpmTagPostInProg, "/bin/sh")
+	h.addString(rpmTagPreUn, spec.PreRemove)
+	h.addString(rpmTagPreUnProg, "/bin/sh")
+	h.addString(rpmTagPostUn, spec.PostRemove)
+	h.addString(rpmTagPostUnProg, "/bin/sh")
+
+	h.addStringArray(rpmTagProvideName, []string{spec.Name})
+	h.addInt32(rpmTagProvideFlags, rpmSenseEqual)
+	h.addStringArray(rpmTagProvideVersion, []string{spec.Version + "-" + spec.Release})
+
+	if len(packageConfig.Rpm.Requires) > 0 {
+		var names, versions []string
+		var flags []int32
+		for _, req := range packageConfig.Rpm.Requires {
+			name, flag, version := parseRpmDependency(req)
+			names = append(names, name)
+			flags = append(flags, flag)
+			versions = append(versions, version)
+		}
+		h.addStringArray(rpmTagRequireName, names)
+		h.addInt32(rpmTagRequireFlags, flags...)
+		h.addStringArray(rpmTagRequireVersion, versions)
+	}
+
+	var (
+		sizes, mtimes, flags, verify, devices, inodes, dirIndexes []int32
+		modes, rdevs                                              []uint16
+		digests, linkTos, users, groups, langs, baseNames         []string
+		dirNames                                                  []string
+	)
+	dirIndex := make(map[string]int32)
+	for i, f := range spec.Files {
+		dir, base := path.Split(f.Path)
+		idx, ok := dirIndex[dir]
+		if !ok {
+			idx = int32(len(dirNames))
+			dirIndex[dir] = idx
+			dirNames = append(dirNames, dir)
+		}
+		dirIndexes = append(dirIndexes, idx)
+		baseNames = append(baseNames, base)
+
+		mode := uint16(f.Mode.Perm()) | 0100000
+		digest := ""
+		if f.Dir {
+			mode = uint16(f.Mode.Perm()) | 040000
+		} else {
+			sum := sha256.Sum256(f.Data)
+			digest = hex.EncodeToString(sum[:])
+		}
+		var flag int32
+		if f.Conffile {
+			flag = rpmFileConfig | rpmFileNoReplace
+		}
+		sizes = append(sizes, int32(len(f.Data)))
+		mtimes = append(mtimes, int32(spec.BuildTime.Unix()))
+		flags = append(flags, flag)
+		verify = append(verify, -1)
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(i+1))
+		modes = append(modes, mode)
+		rdevs = append(rdevs, 0)
+		digests = append(digests, digest)
+		linkTos = append(linkTos, "")
+		users = append(users, "root")
+		groups = append(groups, "root")
+		langs = append(langs, "")
+	}
+	h.addInt32(rpmTagFileSizes, sizes...)
+	h.addInt16(rpmTagFileModes, modes...)
+	h.addInt16(rpmTagFileRdevs, rdevs...)
+	h.addInt32(rpmTagFileMtimes, mtimes...)
+	h.addStringArray(rpmTagFileDigests, digests)
+	h.addStringArray(rpmTagFileLinkTos, linkTos)
+	h.addInt32(rpmTagFileFlags, flags...)
+	h.addStringArray(rpmTagFileUserName, users)
+	h.addStringArray(rpmTagFileGroupName, groups)
+	h.addInt32(rpmTagFileVerifyFlags, verify...)
+	h.addInt32(rpmTagFileDevices, devices...)
+	h.addInt32(rpmTagFileInodes, inodes...)
+	h.addStringArray(rpmTagFileLangs, langs)
+	h.addInt32(rpmTagDirIndexes, dirIndexes...)
+	h.addStringArray(rpmTagBaseNames, baseNames)
+	h.addStringArray(rpmTagDirNames, dirNames)
+	h.addInt32(rpmTagFileDigestAlgo, rpmDigestAlgoSHA256)
+
+	h.addString(rpmTagPayloadFormat, "cpio")
+	h.addString(rpmTagPayloadCompress, "gzip")
+	h.addString(rpmTagPayloadFlags, "9")
+	return h
+}
+
+// parseRpmDependency splits a dependency such as "glibc >= 2.17" into name, sense flags and version.
+func parseRpmDependency(dep string) (string, int32, string) {
+	fields := strings.Fields(dep)
+	if len(fields) != 3 {
+		return strings.TrimSpace(dep), 0, ""
+	}
+	var flag int32
+	switch fields[1] {
+	case "<":
+		flag = rpmSenseLess
+	case "<=":
+		flag = rpmSenseLess | rpmSenseEqual
+	case "=", "==":
+		flag = rpmSenseEqual
+	case ">=":
+		flag = rpmSenseGreater | rpmSenseEqual
+	case ">":
+		flag = rpmSenseGreater
+	default:
+		return strings.TrimSpace(dep), 0, ""
+	}
+	return fields[0], flag, fields[2]
+}
+
+// rpmPayload returns the gzip compressed cpio (newc) archive of the package files and its uncompressed size.
+func rpmPayload(spec *packageSpec) ([]byte, int, error) {
+	var cpio bytes.Buffer
+	writeEntry := func(name string, ino int, mode uint32, nlink int, data []byte) {
+		fmt.Fprintf(&cpio, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+			ino, mode, 0, 0, nlink, spec.BuildTime.Unix(), len(data), 0, 0, 0, 0, len(name)+1, 0)
+		cpio.WriteString(name)
+		cpio.WriteByte(0)
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+		cpio.Write(data)
+		for cpio.Len()%4 != 0 {
+			cpio.WriteByte(0)
+		}
+	}
+	for i, f := range spec.Files {
+		if f.Dir {
+			writeEntry("."+f.Path, i+1, uint32(f.Mode.Perm())|040000, 2, nil)
+		} else {
+			writeEntry("."+f.Path, i+1, uint32(f.Mode.Perm())|0100000, 1, f.Data)
+		}
+	}
+	writeEntry("TRAILER!!!", 0, 0, 1, nil)
+
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := gz.Write(cpio.Bytes()); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), cpio.Len(), nil
+}
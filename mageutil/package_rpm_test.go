@@ -0,0 +1,364 @@
+package mageutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testPackageSpec returns a package with a directory, an executable and a config file.
+func testPackageSpec() *packageSpec {
+	return &packageSpec{
+		Name:      "gomake-test",
+		Version:   "1.2.3+4.gabcdef",
+		Release:   "1",
+		GOOS:      "linux",
+		GOARCH:    "amd64",
+		Prefix:    "/opt/gomake-test",
+		Summary:   "Test package",
+		License:   "Apache-2.0",
+		BuildTime: time.Unix(1700000000, 0),
+		Files: []packageFile{
+			{Path: "/opt/gomake-test/bin", Dir: true, Mode: 0755},
+			{Path: "/opt/gomake-test/bin/api", Mode: 0755, Data: []byte("#!/bin/sh\necho api\n")},
+			{Path: "/opt/gomake-test/etc/config.yml", Mode: 0644, Data: []byte("port: 10002\n"), Conffile: true},
+		},
+		PostInstall: "systemctl daemon-reload",
+		PreRemove:   "systemctl stop 'gomake-test-api@*.service'",
+		PostRemove:  "systemctl daemon-reload",
+	}
+}
+
+// rpmTestHeader is a parsed header structure, entries holds the raw data of every tag.
+type rpmTestHeader struct {
+	entries map[int32]rpmEntry
+}
+
+// parseRpmTestHeader parses the header structure at the start of data and returns it with its length.
+func parseRpmTestHeader(t *testing.T, data []byte, regionTag int32) (*rpmTestHeader, int) {
+	t.Helper()
+	if len(data) < 16 || !bytes.Equal(data[:8], []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}) {
+		t.Fatal("bad header magic")
+	}
+	nindex := int(binary.BigEndian.Uint32(data[8:]))
+	hsize := int(binary.BigEndian.Uint32(data[12:]))
+	storeStart := 16 + 16*nindex
+	if len(data) < storeStart+hsize {
+		t.Fatalf("header of %d entries and %d bytes is truncated", nindex, hsize)
+	}
+	store := data[storeStart : storeStart+hsize]
+
+	h := &rpmTestHeader{entries: make(map[int32]rpmEntry)}
+	for i := 0; i < nindex; i++ {
+		raw := data[16+16*i:]
+		tag := int32(binary.BigEndian.Uint32(raw))
+		typ := int32(binary.BigEndian.Uint32(raw[4:]))
+		offset := int(binary.BigEndian.Uint32(raw[8:]))
+		count := int32(binary.BigEndian.Uint32(raw[12:]))
+		if i == 0 {
+			// The region tag comes first and points to a trailer covering every entry.
+			if tag != regionTag || typ != rpmTypeBin || count != 16 || offset+16 != hsize {
+				t.Fatalf("bad region entry: tag %d, type %d, offset %d, count %d", tag, typ, offset, count)
+			}
+			trailer := store[offset:]
+			if int32(binary.BigEndian.Uint32(trailer)) != regionTag ||
+				int32(binary.BigEndian.Uint32(trailer[8:])) != int32(-16*nindex) {
+				t.Fatal("bad region trailer")
+			}
+			continue
+		}
+		if offset > hsize {
+			t.Fatalf("tag %d: offset %d out of the %d bytes store", tag, offset, hsize)
+		}
+		value := store[offset:]
+		var size int
+		switch typ {
+		case rpmTypeInt16:
+			size = 2 * int(count)
+			if offset%2 != 0 {
+				t.Errorf("tag %d: int16 data at unaligned offset %d", tag, offset)
+			}
+		case rpmTypeInt32:
+			size = 4 * int(count)
+			if offset%4 != 0 {
+				t.Errorf("tag %d: int32 data at unaligned offset %d", tag, offset)
+			}
+		case rpmTypeBin:
+			size = int(count)
+		case rpmTypeString, rpmTypeI18NString, rpmTypeStringArray:
+			for n := 0; n < int(count); n++ {
+				end := bytes.IndexByte(value[size:], 0)
+				if end < 0 {
+					t.Fatalf("tag %d: unterminated string", tag)
+				}
+				size += end + 1
+			}
+		default:
+			t.Fatalf("tag %d: unexpected type %d", tag, typ)
+		}
+		h.entries[tag] = rpmEntry{tag: tag, typ: typ, count: count, data: value[:size]}
+	}
+	return h, storeStart + hsize
+}
+
+func (h *rpmTestHeader) entry(t *testing.T, tag int32, typ int32) rpmEntry {
+	t.Helper()
+	e, ok := h.entries[tag]
+	if !ok {
+		t.Fatalf("tag %d is missing", tag)
+	}
+	if e.typ != typ {
+		t.Fatalf("tag %d has type %d, want %d", tag, e.typ, typ)
+	}
+	return e
+}
+
+func (h *rpmTestHeader) strings(t *testing.T, tag int32, typ int32) []string {
+	t.Helper()
+	e := h.entry(t, tag, typ)
+	values := bytes.Split(bytes.TrimSuffix(e.data, []byte{0}), []byte{0})
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = string(v)
+	}
+	return out
+}
+
+func (h *rpmTestHeader) string(t *testing.T, tag int32) string {
+	t.Helper()
+	return h.strings(t, tag, rpmTypeString)[0]
+}
+
+func (h *rpmTestHeader) int32s(t *testing.T, tag int32) []int32 {
+	t.Helper()
+	e := h.entry(t, tag, rpmTypeInt32)
+	out := make([]int32, e.count)
+	for i := range out {
+		out[i] = int32(binary.BigEndian.Uint32(e.data[4*i:]))
+	}
+	return out
+}
+
+func (h *rpmTestHeader) int16s(t *testing.T, tag int32) []uint16 {
+	t.Helper()
+	e := h.entry(t, tag, rpmTypeInt16)
+	out := make([]uint16, e.count)
+	for i := range out {
+		out[i] = binary.BigEndian.Uint16(e.data[2*i:])
+	}
+	return out
+}
+
+// cpioTestEntry is a member of a cpio (newc) archive.
+type cpioTestEntry struct {
+	name string
+	mode uint32
+	data string
+}
+
+func parseCpioTest(t *testing.T, archive []byte) []cpioTestEntry {
+	t.Helper()
+	align := func(n int) int { return (n + 3) &^ 3 }
+	field := func(header []byte, i int) int {
+		v, err := strconv.ParseUint(string(header[6+8*i:14+8*i]), 16, 32)
+		if err != nil {
+			t.Fatalf("bad cpio header field %d: %v", i, err)
+		}
+		return int(v)
+	}
+
+	var entries []cpioTestEntry
+	for pos := 0; ; {
+		if len(archive) < pos+110 || string(archive[pos:pos+6]) != "070701" {
+			t.Fatalf("bad cpio header at offset %d", pos)
+		}
+		header := archive[pos : pos+110]
+		mode, size, nameSize := field(header, 1), field(header, 6), field(header, 11)
+		name := string(archive[pos+110 : pos+110+nameSize-1])
+		pos = align(pos + 110 + nameSize)
+		if name == "TRAILER!!!" {
+			return entries
+		}
+		entries = append(entries, cpioTestEntry{name: name, mode: uint32(mode), data: string(archive[pos : pos+size])})
+		pos = align(pos + size)
+	}
+}
+
+func TestWriteRpm(t *testing.T) {
+	requires := packageConfig.Rpm.Requires
+	t.Cleanup(func() { packageConfig.Rpm.Requires = requires })
+	packageConfig.Rpm.Requires = []string{"glibc >= 2.17", "bash"}
+
+	spec := testPackageSpec()
+	output, err := writeRpm(spec, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lead := data[:96]
+	if !bytes.Equal(lead[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("bad lead magic")
+	}
+	if name := string(bytes.TrimRight(lead[10:76], "\x00")); name != "gomake-test-1.2.3+4.gabcdef-1" {
+		t.Errorf("lead name = %q", name)
+	}
+	if sigType := binary.BigEndian.Uint16(lead[78:]); sigType != 5 {
+		t.Errorf("lead signature type = %d, want 5", sigType)
+	}
+
+	sig, sigSize := parseRpmTestHeader(t, data[96:], rpmTagHeaderSignatures)
+	headerStart := 96 + sigSize
+	headerStart += (8 - headerStart%8) % 8
+	header, headerSize := parseRpmTestHeader(t, data[headerStart:], rpmTagHeaderImmutable)
+	headerBytes := data[headerStart : headerStart+headerSize]
+	payload := data[headerStart+headerSize:]
+
+	// Signature: sizes and digests of the header and payload.
+	if got := sig.int32s(t, rpmSigTagSize); got[0] != int32(len(headerBytes)+len(payload)) {
+		t.Errorf("signature size = %d, want %d", got[0], len(headerBytes)+len(payload))
+	}
+	headerSum := sha256.Sum256(headerBytes)
+	if got := sig.string(t, rpmSigTagSHA256); got != hex.EncodeToString(headerSum[:]) {
+		t.Errorf("signature sha256 = %s, want %s", got, hex.EncodeToString(headerSum[:]))
+	}
+	md5sum := md5.Sum(append(append([]byte{}, headerBytes...), payload...))
+	if got := sig.entry(t, rpmSigTagMD5, rpmTypeBin).data; !bytes.Equal(got, md5sum[:]) {
+		t.Errorf("signature md5 = %x, want %x", got, md5sum)
+	}
+
+	// Main header: package metadata.
+	for tag, want := range map[int32]string{
+		rpmTagName:            "gomake-test",
+		rpmTagVersion:         "1.2.3+4.gabcdef",
+		rpmTagRelease:         "1",
+		rpmTagLicense:         "Apache-2.0",
+		rpmTagOS:              "linux",
+		rpmTagArch:            "x86_64",
+		rpmTagPostIn:          "systemctl daemon-reload",
+		rpmTagPreUn:           "systemctl stop 'gomake-test-api@*.service'",
+		rpmTagPreUnProg:       "/bin/sh",
+		rpmTagPayloadFormat:   "cpio",
+		rpmTagPayloadCompress: "gzip",
+	} {
+		if got := header.string(t, tag); got != want {
+			t.Errorf("tag %d = %q, want %q", tag, got, want)
+		}
+	}
+	if got := header.strings(t, rpmTagSummary, rpmTypeI18NString); !reflect.DeepEqual(got, []string{"Test package"}) {
+		t.Errorf("summary = %q", got)
+	}
+	if got := header.int32s(t, rpmTagSize); got[0] != int32(spec.installedSize()) {
+		t.Errorf("size = %d, want %d", got[0], spec.installedSize())
+	}
+	if got := header.strings(t, rpmTagRequireName, rpmTypeStringArray); !reflect.DeepEqual(got, []string{"glibc", "bash"}) {
+		t.Errorf("requires = %q", got)
+	}
+	if got := header.int32s(t, rpmTagRequireFlags); !reflect.DeepEqual(got, []int32{rpmSenseGreater | rpmSenseEqual, 0}) {
+		t.Errorf("require flags = %v", got)
+	}
+
+	// Main header: file list.
+	dirNames := header.strings(t, rpmTagDirNames, rpmTypeStringArray)
+	baseNames := header.strings(t, rpmTagBaseNames, rpmTypeStringArray)
+	dirIndexes := header.int32s(t, rpmTagDirIndexes)
+	var paths []string
+	for i, base := range baseNames {
+		paths = append(paths, dirNames[dirIndexes[i]]+base)
+	}
+	wantPaths := []string{"/opt/gomake-test/bin", "/opt/gomake-test/bin/api", "/opt/gomake-test/etc/config.yml"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("files = %q, want %q", paths, wantPaths)
+	}
+	if got := header.int16s(t, rpmTagFileModes); !reflect.DeepEqual(got, []uint16{040755, 0100755, 0100644}) {
+		t.Errorf("file modes = %o", got)
+	}
+	if got := header.int32s(t, rpmTagFileFlags); !reflect.DeepEqual(got, []int32{0, 0, rpmFileConfig | rpmFileNoReplace}) {
+		t.Errorf("file flags = %v", got)
+	}
+	configSum := sha256.Sum256(spec.Files[2].Data)
+	if got := header.strings(t, rpmTagFileDigests, rpmTypeStringArray); got[0] != "" || got[2] != hex.EncodeToString(configSum[:]) {
+		t.Errorf("file digests = %q", got)
+	}
+
+	// Payload: a gzip compressed cpio archive of the files, with the size recorded in the signature.
+	gz, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sig.int32s(t, rpmSigTagPayloadSize); got[0] != int32(len(archive)) {
+		t.Errorf("signature payload size = %d, want %d", got[0], len(archive))
+	}
+	wantEntries := []cpioTestEntry{
+		{name: "./opt/gomake-test/bin", mode: 040755},
+		{name: "./opt/gomake-test/bin/api", mode: 0100755, data: "#!/bin/sh\necho api\n"},
+		{name: "./opt/gomake-test/etc/config.yml", mode: 0100644, data: "port: 10002\n"},
+	}
+	if got := parseCpioTest(t, archive); !reflect.DeepEqual(got, wantEntries) {
+		t.Errorf("payload = %+v, want %+v", got, wantEntries)
+	}
+
+	// Cross-check with rpm itself where it is installed.
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return
+	}
+	out, err := exec.Command("rpm", "-qp", "--nosignature", "--queryformat", "%{NAME}-%{VERSION}-%{RELEASE}.%{ARCH}\\n", output).Output()
+	if err != nil {
+		t.Fatalf("rpm -qp: %v", err)
+	}
+	if got := string(out); got != "gomake-test-1.2.3+4.gabcdef-1.x86_64\n" {
+		t.Errorf("rpm -qp = %q", got)
+	}
+	out, err = exec.Command("rpm", "-qlp", "--nosignature", output).Output()
+	if err != nil {
+		t.Fatalf("rpm -qlp: %v", err)
+	}
+	if got := string(out); got != "/opt/gomake-test/bin\n/opt/gomake-test/bin/api\n/opt/gomake-test/etc/config.yml\n" {
+		t.Errorf("rpm -qlp = %q", got)
+	}
+}
+
+func TestParseRpmDependency(t *testing.T) {
+	tests := []struct {
+		dep     string
+		name    string
+		flag    int32
+		version string
+	}{
+		{"bash", "bash", 0, ""},
+		{" bash ", "bash", 0, ""},
+		{"glibc >= 2.17", "glibc", rpmSenseGreater | rpmSenseEqual, "2.17"},
+		{"glibc > 2.17", "glibc", rpmSenseGreater, "2.17"},
+		{"glibc = 2.17", "glibc", rpmSenseEqual, "2.17"},
+		{"glibc == 2.17", "glibc", rpmSenseEqual, "2.17"},
+		{"glibc <= 2.17", "glibc", rpmSenseLess | rpmSenseEqual, "2.17"},
+		{"glibc < 2.17", "glibc", rpmSenseLess, "2.17"},
+		{"glibc ~ 2.17", "glibc ~ 2.17", 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dep, func(t *testing.T) {
+			name, flag, version := parseRpmDependency(tt.dep)
+			if name != tt.name || flag != tt.flag || version != tt.version {
+				t.Errorf("parseRpmDependency(%q) = %q, %d, %q, want %q, %d, %q",
+					tt.dep, name, flag, version, tt.name, tt.flag, tt.version)
+			}
+		})
+	}
+}
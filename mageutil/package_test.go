@@ -0,0 +1,81 @@
+package mageutil
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct {
+		word string
+		want string
+	}{
+		{"-i", "-i"},
+		{"/opt/app/config/", "/opt/app/config/"},
+		{"", `""`},
+		{"a b", `"a b"`},
+		{"50%", "50%%"},
+		{"$HOME", "$$HOME"},
+		{`say "hi"`, `"say \"hi\""`},
+		{`C:\dir`, `"C:\\dir"`},
+		{"a;b", `"a;b"`},
+		{"it's", `"it's"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.word, func(t *testing.T) {
+			if got := systemdQuote(tt.word); got != tt.want {
+				t.Errorf("systemdQuote(%q) = %s, want %s", tt.word, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPackagePreRemoveScript runs the script with a systemctl that records its arguments, it is skipped without sh.
+func TestPackagePreRemoveScript(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	binaries := serviceBinaries
+	t.Cleanup(func() { serviceBinaries = binaries })
+	serviceBinaries = map[string]int{"rpc": 1, "api": 2, "disabled": 0}
+
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{arg: "remove", want: "stop gomake-test-api@*.service\n" +
+			"disable gomake-test-api@0.service gomake-test-api@1.service\n" +
+			"stop gomake-test-disabled@*.service\n" +
+			"stop gomake-test-rpc@*.service\n" +
+			"disable gomake-test-rpc@0.service\n"},
+		{arg: "0", want: "stop gomake-test-api@*.service\n" +
+			"disable gomake-test-api@0.service gomake-test-api@1.service\n" +
+			"stop gomake-test-disabled@*.service\n" +
+			"stop gomake-test-rpc@*.service\n" +
+			"disable gomake-test-rpc@0.service\n"},
+		{arg: "upgrade"},
+		{arg: "1"},
+	}
+	script := packagePreRemoveScript("gomake-test")
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			dir := t.TempDir()
+			calls := filepath.Join(dir, "calls")
+			systemctl := "#!/bin/sh\necho \"$@\" >> " + calls + "\nexit 1\n"
+			if err := os.WriteFile(filepath.Join(dir, "systemctl"), []byte(systemctl), 0755); err != nil {
+				t.Fatal(err)
+			}
+			cmd := exec.Command("sh", "-e", "-c", script, "prerm", tt.arg)
+			cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("script failed: %v\n%s", err, out)
+			}
+			got, _ := os.ReadFile(calls)
+			if string(got) != tt.want {
+				t.Errorf("systemctl calls =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ const (
 	LogsDir      = "logs"
 	BinDir       = "bin"
 	PlatformsDir = "platforms"
+	TestDir      = "test"
 )
 
 // PathConfig represents the path configuration structure
@@ -163,6 +164,25 @@ func UpdateGlobalPaths(opts *PathOptions) error {
 	return nil
 }
 
+// applyOverrides points the host binary, tools, config, logs and tmp directories to the configured locations.
+func (p *PathConfig) applyOverrides(o PathsConfig) {
+	if o.Bin != "" {
+		p.OutputHostBin = p.joinPath(o.Bin)
+	}
+	if o.Tools != "" {
+		p.OutputHostBinTools = p.joinPath(o.Tools)
+	}
+	if o.Config != "" {
+		p.Config = p.joinPath(o.Config)
+	}
+	if o.Logs != "" {
+		p.OutputLogs = p.joinPath(o.Logs)
+	}
+	if o.Tmp != "" {
+		p.OutputTmp = p.joinPath(o.Tmp)
+	}
+}
+
 // joinPath helper method: joins path and adds separator
 func (p *PathConfig) joinPath(elements ...string) string {
 	path := filepath.Join(elements...)
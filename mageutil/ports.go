@@ -0,0 +1,173 @@
+package mageutil
+
+import (
+	"fmt"
+	stdnet "net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+	"gopkg.in/yaml.v3"
+)
+
+// PortConfig is the port scheme of a service, written as a base port (instance n gets base+n), a list with the
+// port of each instance, or "auto" to pick a free port for every instance when it starts.
+type PortConfig struct {
+	Base int
+	List []int
+	Auto bool
+}
+
+func (c *PortConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&c.List)
+	}
+	if value.Kind == yaml.ScalarNode && value.Value == "auto" {
+		c.Auto = true
+		return nil
+	}
+	return value.Decode(&c.Base)
+}
+
+func (c PortConfig) String() string {
+	switch {
+	case c.Auto:
+		return "auto"
+	case len(c.List) > 0:
+		ports := make([]string, len(c.List))
+		for i, port := range c.List {
+			ports[i] = strconv.Itoa(port)
+		}
+		return "[" + strings.Join(ports, ", ") + "]"
+	default:
+		return strconv.Itoa(c.Base)
+	}
+}
+
+func (c PortConfig) validate() error {
+	ports := append([]int{c.Base}, c.List...)
+	for _, port := range ports {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// fixedPort returns the configured port of instance index, 0 when the service has no port or picks it
+// automatically.
+func (c PortConfig) fixedPort(index int) (int, error) {
+	switch {
+	case c.Auto:
+		return 0, nil
+	case len(c.List) > 0:
+		if index >= len(c.List) {
+			return 0, fmt.Errorf("the port list %s has no port for instance %d", c, index)
+		}
+		return c.List[index], nil
+	case c.Base != 0:
+		return c.Base + index, nil
+	}
+	return 0, nil
+}
+
+// assignPort returns the port of instance index, picking a free one for "auto", and checks that it is free.
+func (c PortConfig) assignPort(index int) (int, error) {
+	if c.Auto {
+		return freePort()
+	}
+	port, err := c.fixedPort(index)
+	if err != nil || port == 0 {
+		return port, err
+	}
+	return port, checkPortFree(port)
+}
+
+// freePort asks the system for a free TCP port.
+func freePort() (int, error) {
+	l, err := stdnet.Listen("tcp", ":0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*stdnet.TCPAddr).Port, nil
+}
+
+// checkPortFree returns an error naming the owning process when a TCP port is already in use.
+func checkPortFree(port int) error {
+	l, err := stdnet.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err == nil {
+		return l.Close()
+	}
+	return fmt.Errorf("port %d is already in use by %s", port, portOwner(port))
+}
+
+// portOwner describes the process listening on a TCP port.
+func portOwner(port int) string {
+	conns, err := net.Connections("tcp")
+	if err == nil {
+		for _, conn := range conns {
+			if conn.Status != "LISTEN" || conn.Laddr.Port != uint32(port) || conn.Pid == 0 {
+				continue
+			}
+			if p, err := process.NewProcess(conn.Pid); err == nil {
+				if cmdline, err := p.Cmdline(); err == nil && cmdline != "" {
+					return fmt.Sprintf("pid %d (%s)", conn.Pid, cmdline)
+				}
+			}
+			return fmt.Sprintf("pid %d", conn.Pid)
+		}
+	}
+	return "another process"
+}
+
+// checkServicePorts checks before launch that the fixed ports of every instance of the given services are free and
+// not shared by two instances, reporting all conflicts at once.
+func checkServicePorts(counts map[string]int) error {
+	services := make([]string, 0, len(counts))
+	for service := range counts {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	owners := make(map[int]string)
+	var conflicts []string
+	for _, service := range services {
+		cfg := getServiceConfig(service)
+		for index := 0; index < counts[service]; index++ {
+			name := fmt.Sprintf("%s[%d]", service, index)
+			port, err := cfg.Port.fixedPort(index)
+			if err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			if port == 0 {
+				continue
+			}
+			if owner, ok := owners[port]; ok {
+				conflicts = append(conflicts, fmt.Sprintf("%s: port %d is also assigned to %s", name, port, owner))
+				continue
+			}
+			owners[port] = name
+			if err := checkPortFree(port); err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("port conflicts:\n%s", strings.Join(conflicts, "\n"))
+	}
+	return nil
+}
+
+// instancePort returns the port of a running instance from the state file, falling back to its configured port.
+func instancePort(state *State, service string, index int) int {
+	for _, inst := range state.InstancesOf(service) {
+		if inst.Index == index && inst.Port != 0 {
+			return inst.Port
+		}
+	}
+	port, _ := getServiceConfig(service).Port.fixedPort(index)
+	return port
+}
@@ -0,0 +1,466 @@
+package mageutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProbesConfig holds the probes of a service. Readiness is awaited by `mage start`, liveness is reported by
+// `mage check`, which falls back to the readiness probe when no liveness probe is configured.
+type ProbesConfig struct {
+	Readiness *ProbeConfig `yaml:"readiness"`
+	Liveness  *ProbeConfig `yaml:"liveness"`
+}
+
+// ProbeConfig is a single check of an instance, exactly one of TCP, HTTP, GRPC and Exec must be set. Addresses,
+// URLs and commands are templates like the launch settings, see InstanceTemplateData, in which {index} and {port}
+// are aliases of {{.Index}} and {{.Port}}.
+type ProbeConfig struct {
+	TCP          string        `yaml:"tcp"` // host:port to connect to
+	HTTP         *HTTPProbe    `yaml:"http"`
+	GRPC         *GRPCProbe    `yaml:"grpc"`
+	Exec         []string      `yaml:"exec"`         // Command and arguments, healthy when it exits with 0
+	Timeout      time.Duration `yaml:"timeout"`      // Timeout of one attempt, default 1s
+	Interval     time.Duration `yaml:"interval"`     // Delay between attempts while waiting for readiness, default 1s
+	StartTimeout time.Duration `yaml:"startTimeout"` // How long `mage start` waits for readiness, default 60s
+}
+
+// HTTPProbe sends a GET request and expects the given status, or any 2xx or 3xx status.
+type HTTPProbe struct {
+	URL    string `yaml:"url"`
+	Status int    `yaml:"status"`
+}
+
+// GRPCProbe calls grpc.health.v1.Health/Check over plaintext HTTP/2 and expects SERVING.
+type GRPCProbe struct {
+	Address string `yaml:"address"`
+	Service string `yaml:"service"` // Service name sent in the request, empty checks the whole server
+}
+
+func (p ProbeConfig) withDefaults() ProbeConfig {
+	if p.Timeout <= 0 {
+		p.Timeout = time.Second
+	}
+	if p.Interval <= 0 {
+		p.Interval = time.Second
+	}
+	if p.StartTimeout <= 0 {
+		p.StartTimeout = time.Minute
+	}
+	return p
+}
+
+func (p *ProbeConfig) validate() error {
+	kinds := 0
+	if p.TCP != "" {
+		kinds++
+	}
+	if p.HTTP != nil {
+		kinds++
+		if p.HTTP.URL == "" {
+			return errors.New("http probe requires a url")
+		}
+	}
+	if p.GRPC != nil {
+		kinds++
+		if p.GRPC.Address == "" {
+			return errors.New("grpc probe requires an address")
+		}
+	}
+	if len(p.Exec) > 0 {
+		kinds++
+	}
+	if kinds != 1 {
+		return errors.New("a probe needs exactly one of tcp, http, grpc and exec")
+	}
+	for _, text := range p.templates() {
+		if _, err := expandInstance("probe", text, InstanceTemplateData{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templates returns the settings of the probe that are expanded for each instance.
+func (p ProbeConfig) templates() []string {
+	switch {
+	case p.TCP != "":
+		return []string{p.TCP}
+	case p.HTTP != nil:
+		return []string{p.HTTP.URL}
+	case p.GRPC != nil:
+		return []string{p.GRPC.Address}
+	}
+	return append([]string(nil), p.Exec...)
+}
+
+func (p ProbeConfig) String() string {
+	switch {
+	case p.TCP != "":
+		return "tcp " + p.TCP
+	case p.HTTP != nil:
+		return "http " + p.HTTP.URL
+	case p.GRPC != nil:
+		return "grpc " + p.GRPC.Address
+	default:
+		return "exec " + strings.Join(p.Exec, " ")
+	}
+}
+
+// readinessProbe returns the readiness probe of a service, or nil.
+func readinessProbe(binary string) *ProbeConfig {
+	probes := getServiceConfig(binary).Probes
+	if probes.Readiness == nil {
+		return nil
+	}
+	probe := probes.Readiness.withDefaults()
+	return &probe
+}
+
+// livenessProbe returns the liveness probe of a service, falling back to its readiness probe, or nil.
+func livenessProbe(binary string) *ProbeConfig {
+	probes := getServiceConfig(binary).Probes
+	if probes.Liveness == nil {
+		return readinessProbe(binary)
+	}
+	probe := probes.Liveness.withDefaults()
+	return &probe
+}
+
+// run performs one attempt of the probe against an instance.
+func (p ProbeConfig) run(data InstanceTemplateData) error {
+	expanded := p.templates()
+	for i, text := range expanded {
+		value, err := expandInstance("probe", text, data)
+		if err != nil {
+			return err
+		}
+		expanded[i] = value
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+
+	switch {
+	case p.TCP != "":
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", expanded[0])
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case p.HTTP != nil:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, expanded[0], nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if p.HTTP.Status != 0 && resp.StatusCode != p.HTTP.Status {
+			return fmt.Errorf("status %s, expected %d", resp.Status, p.HTTP.Status)
+		}
+		if p.HTTP.Status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 399) {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+
+	case p.GRPC != nil:
+		return grpcHealthCheck(ctx, expanded[0], p.GRPC.Service)
+
+	default:
+		cmd := exec.CommandContext(ctx, expanded[0], expanded[1:]...)
+		cmd.Dir = Paths.Root
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				return fmt.Errorf("%v: %s", err, msg)
+			}
+			return err
+		}
+		return nil
+	}
+}
+
+// waitReady retries the probe until it succeeds, the instance exits or the start timeout expires.
+func (p ProbeConfig) waitReady(inst *InstanceState) error {
+	deadline := time.Now().Add(p.StartTimeout)
+	for {
+		err := p.run(newInstanceTemplateData(inst.Service, inst.Index, inst.Port))
+		if err == nil {
+			return nil
+		}
+		if inst.Process() == nil {
+			return errors.New("exited")
+		}
+		if time.Now().Add(p.Interval).After(deadline) {
+			return fmt.Errorf("not ready after %s: %v", p.StartTimeout, err)
+		}
+		time.Sleep(p.Interval)
+	}
+}
+
+// waitInstancesReady waits in parallel for the readiness probes of the instances. Instances of services without a
+// readiness probe only need to be running, after a short settle time when settle is set.
+func waitInstancesReady(instances []*InstanceState, settle bool) error {
+	if len(instances) == 0 {
+		return nil
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures []string
+	)
+	fail := func(inst *InstanceState, err error) {
+		mu.Lock()
+		failures = append(failures, fmt.Sprintf("%s[%d]: %v", inst.Service, inst.Index, err))
+		mu.Unlock()
+	}
+	for _, inst := range instances {
+		wg.Add(1)
+		go func(inst *InstanceState) {
+			defer wg.Done()
+			probe := readinessProbe(inst.Service)
+			if probe == nil {
+				if settle {
+					time.Sleep(waveSettleTime)
+				}
+				if inst.Process() == nil {
+					fail(inst, errors.New("exited"))
+				}
+				return
+			}
+			if err := probe.waitReady(inst); err != nil {
+				fail(inst, err)
+				return
+			}
+			PrintGreen(fmt.Sprintf("%s[%d] is ready (%s)", inst.Service, inst.Index, probe))
+		}(inst)
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		return fmt.Errorf("instances are not ready:\n%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// checkInstancesHealth runs the liveness probe of the selected running instances and prints whether they are
+// healthy.
+func checkInstancesHealth(selection instanceSelection) error {
+	procs, err := selectedProcesses(selection)
+	if err != nil {
+		return err
+	}
+
+	state := loadStateOrEmpty()
+	type result struct {
+		name  string
+		probe *ProbeConfig
+		err   error
+	}
+	var results []*result
+	var wg sync.WaitGroup
+	for _, service := range selection.services() {
+		probe := livenessProbe(service)
+		if probe == nil {
+			continue
+		}
+		for _, p := range procs[service] {
+			index := processInstanceIndex(state, service, p)
+			data := newInstanceTemplateData(service, index, instancePort(state, service, index))
+			r := &result{name: fmt.Sprintf("%s[%d] pid %d", service, index, p.Pid), probe: probe}
+			results = append(results, r)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r.err = probe.run(data)
+			}()
+		}
+	}
+	wg.Wait()
+
+	var unhealthy []string
+	for _, r := range results {
+		if r.err != nil {
+			PrintRed(fmt.Sprintf("%s is unhealthy (%s): %v", r.name, r.probe, r.err))
+			unhealthy = append(unhealthy, r.name)
+		} else {
+			PrintGreen(fmt.Sprintf("%s is healthy (%s)", r.name, r.probe))
+		}
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("unhealthy instances: %s", strings.Join(unhealthy, ", "))
+	}
+	return nil
+}
+
+// grpcHealthCheck calls grpc.health.v1.Health/Check with a minimal plaintext HTTP/2 client, which avoids a gRPC
+// dependency. Response headers are skipped, only the response message is decoded.
+func grpcHealthCheck(ctx context.Context, address, service string) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	const (
+		frameData     = 0x0
+		frameHeaders  = 0x1
+		frameRSTStrm  = 0x3
+		frameSettings = 0x4
+		framePing     = 0x6
+		frameGoAway   = 0x7
+		flagAck       = 0x1
+		flagEndStream = 0x1
+		flagEndHeader = 0x4
+	)
+	writeFrame := func(w *bytes.Buffer, typ, flags byte, stream uint32, payload []byte) {
+		w.Write([]byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags})
+		binary.Write(w, binary.BigEndian, stream)
+		w.Write(payload)
+	}
+
+	var headers bytes.Buffer
+	for _, field := range [][2]string{
+		{":method", "POST"},
+		{":scheme", "http"},
+		{":path", "/grpc.health.v1.Health/Check"},
+		{":authority", address},
+		{"content-type", "application/grpc"},
+		{"te", "trailers"},
+	} {
+		// Literal header field without indexing, new name, no Huffman coding.
+		headers.WriteByte(0)
+		hpackString(&headers, field[0])
+		hpackString(&headers, field[1])
+	}
+
+	var request []byte
+	if service != "" {
+		request = append([]byte{0x0a}, protoVarint(uint64(len(service)))...)
+		request = append(request, service...)
+	}
+	message := append([]byte{0, 0, 0, 0, 0}, request...)
+	binary.BigEndian.PutUint32(message[1:], uint32(len(request)))
+
+	var out bytes.Buffer
+	out.WriteString("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	writeFrame(&out, frameSettings, 0, 0, nil)
+	writeFrame(&out, frameHeaders, flagEndHeader, 1, headers.Bytes())
+	writeFrame(&out, frameData, flagEndStream, 1, message)
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		return err
+	}
+
+	var body []byte
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return fmt.Errorf("failed to read response: %v", err)
+		}
+		length := int(header[0])<<16 | int(header[1])<<8 | int(header[2])
+		typ, flags := header[3], header[4]
+		stream := binary.BigEndian.Uint32(header[5:]) & 0x7fffffff
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return fmt.Errorf("failed to read response: %v", err)
+		}
+
+		var reply bytes.Buffer
+		switch {
+		case typ == frameSettings && flags&flagAck == 0:
+			writeFrame(&reply, frameSettings, flagAck, 0, nil)
+		case typ == framePing && flags&flagAck == 0:
+			writeFrame(&reply, framePing, flagAck, 0, payload)
+		case typ == frameGoAway:
+			return errors.New("server closed the connection")
+		case typ == frameRSTStrm && stream == 1:
+			return errors.New("server reset the stream")
+		case typ == frameData && stream == 1:
+			body = append(body, payload...)
+		}
+		if reply.Len() > 0 {
+			if _, err := conn.Write(reply.Bytes()); err != nil {
+				return err
+			}
+		}
+		if stream == 1 && (typ == frameData || typ == frameHeaders) && flags&flagEndStream != 0 {
+			break
+		}
+	}
+
+	if len(body) < 5 {
+		return errors.New("no health check response, the service is unknown or the server does not implement grpc.health.v1")
+	}
+	status := grpcHealthStatus(body[5:])
+	if status != 1 {
+		names := map[uint64]string{0: "UNKNOWN", 2: "NOT_SERVING", 3: "SERVICE_UNKNOWN"}
+		return fmt.Errorf("health status %s", names[status])
+	}
+	return nil
+}
+
+// grpcHealthStatus decodes the status field of a HealthCheckResponse message.
+func grpcHealthStatus(msg []byte) uint64 {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return 0
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0: // varint
+			value, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return 0
+			}
+			if key>>3 == 1 {
+				return value
+			}
+			msg = msg[n:]
+		case 2: // length-delimited
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || int(length) > len(msg)-n {
+				return 0
+			}
+			msg = msg[n+int(length):]
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+func protoVarint(v uint64) []byte {
+	return binary.AppendUvarint(nil, v)
+}
+
+// hpackString writes a string literal with a 7-bit prefixed length.
+func hpackString(w *bytes.Buffer, s string) {
+	n := len(s)
+	if n < 127 {
+		w.WriteByte(byte(n))
+	} else {
+		w.WriteByte(127)
+		n -= 127
+		for n >= 128 {
+			w.WriteByte(byte(n%128 + 128))
+			n /= 128
+		}
+		w.WriteByte(byte(n))
+	}
+	w.WriteString(s)
+}
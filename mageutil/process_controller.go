@@ -2,11 +2,11 @@ package mageutil
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
 )
 
@@ -35,31 +35,135 @@ func StartBinaries(specificBinaries ...string) error {
 		binariesToStart = serviceBinaries
 	}
 
-	for binary, count := range binariesToStart {
-		binFullPath := filepath.Join(Paths.OutputHostBin, binary)
+	var binaries []string
+	for binary := range binariesToStart {
+		binaries = append(binaries, binary)
+	}
+	refused, err := verifyServiceBinaries(binaries)
+	if err != nil {
+		return err
+	}
+	if err := checkServicePorts(binariesToStart); err != nil {
+		return err
+	}
 
-		if _, err := os.Stat(binFullPath); err != nil {
-			PrintRed(fmt.Sprintf("Binary not found: %s. Please build first.", binFullPath))
-			continue
+	state, err := LoadState()
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Discarding state file: %v", err))
+		state = &State{}
+	}
+	defer func() {
+		if err := state.Save(); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
 		}
+	}()
 
-		for i := 0; i < count; i++ {
-			configPath := Paths.Config
-			if os.Getenv(DeploymentType) == KUBERNETES {
-				configPath = Paths.K8sConfig
+	waves, err := serviceWaves(binaries)
+	if err != nil {
+		return err
+	}
+	for i, wave := range waves {
+		checksums := make(map[string]string)
+		instances := make(instanceSelection)
+		for _, binary := range wave {
+			binFullPath := filepath.Join(Paths.OutputHostBin, binary)
+
+			if _, err := os.Stat(binFullPath); err != nil {
+				PrintRed(fmt.Sprintf("Binary not found: %s. Please build first.", binFullPath))
+				continue
 			}
-			args := []string{"-i", strconv.Itoa(i), "-c", configPath}
-			cmd := exec.Command(binFullPath, args...)
-			fmt.Printf("Starting %s\n", cmd.String())
-			cmd.Dir = Paths.OutputHostBin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-			if err := cmd.Start(); err != nil {
-				return fmt.Errorf("failed to start %s with args %v: %v", binFullPath, args, err)
+			if _, ok := refused[binary]; ok {
+				PrintRed(fmt.Sprintf("Refusing to start %s, binary failed integrity verification.", binary))
+				continue
+			}
+			checksum, _, err := fileSHA256(binFullPath)
+			if err != nil {
+				return fmt.Errorf("failed to checksum %s: %v", binFullPath, err)
+			}
+			checksums[binary] = checksum
+			for i := 0; i < binariesToStart[binary]; i++ {
+				instances[binary] = append(instances[binary], i)
+			}
+		}
+
+		// One log helper writes the logs of the whole wave.
+		logs := openInstanceLogs(instances)
+		var started []*InstanceState
+		for _, binary := range instances.services() {
+			for _, i := range instances.indexes(binary) {
+				_, inst, err := startInstance(binary, i, checksums[binary], logs)
+				if err != nil {
+					logs.Close()
+					return err
+				}
+				state.Record(inst)
+				started = append(started, inst)
 			}
 		}
+		logs.Close()
+		// The last wave has no dependents, so only its readiness probes are awaited.
+		if err := waitInstancesReady(started, i < len(waves)-1); err != nil {
+			return err
+		}
 	}
-	return nil
+	return refusedBinariesError(refused)
+}
+
+// startInstance launches instance index of a service and returns the command and its state record. The instance
+// writes its output to logs, or to a log helper of its own when logs is nil.
+func startInstance(binary string, index int, checksum string, logs *instanceLogs) (*exec.Cmd, *InstanceState, error) {
+	binFullPath := filepath.Join(Paths.OutputHostBin, binary)
+	cfg := getServiceConfig(binary)
+	port, err := cfg.Port.assignPort(index)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to start %s[%d]: %v", binary, index, err)
+	}
+	launch, err := cfg.launchSpec(newInstanceTemplateData(binary, index, port))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare %s: %v", binary, err)
+	}
+	args := launch.Args
+	if err := os.MkdirAll(launch.Dir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create working directory of %s: %v", binary, err)
+	}
+	if logs == nil {
+		logs = openInstanceLogs(instanceSelection{binary: {index}})
+		defer logs.Close()
+	}
+	logPath := instanceLogPath(binary, index)
+	output, err := logs.output(binary, index)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer output.Close()
+
+	cmd := exec.Command(binFullPath, args...)
+	fmt.Printf("Starting %s, logging to %s\n", cmd.String(), logPath)
+	cmd.Dir = launch.Dir
+	cmd.Env = append(append(os.Environ(), launch.Env...), instanceMarkerEnv(binary, index)...)
+	// Each instance leads its own process group, so stopping it reaches the processes it spawned.
+	cmd.SysProcAttr = detachedSysProcAttr()
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start %s with args %v: %v", binFullPath, args, err)
+	}
+	applyInstanceLimits(binary, index, cmd.Process.Pid, cfg.Limits)
+	inst := newInstanceState(binary, index, cmd.Process.Pid, binFullPath, checksum, args)
+	inst.Port = port
+	return cmd, inst, nil
+}
+
+func refusedBinariesError(refused map[string]error) error {
+	if len(refused) == 0 {
+		return nil
+	}
+	var messages []string
+	for binary, err := range refused {
+		messages = append(messages, fmt.Sprintf("%s: %v", binary, err))
+	}
+	slices.Sort(messages)
+	return fmt.Errorf("binaries failed integrity verification and were not started:\n%s", strings.Join(messages, "\n"))
 }
 
 // StartTools starts all tool binaries or specified ones.
@@ -77,6 +181,23 @@ func StartTools(specificTools ...string) error {
 		toolsToStart = toolBinaries
 	}
 
+	if verifyBinaries {
+		paths := make(map[string]string)
+		for _, tool := range toolsToStart {
+			toolFullPath := GetBinToolsFullPath(tool)
+			if _, err := os.Stat(toolFullPath); err == nil {
+				paths[tool] = toolFullPath
+			}
+		}
+		refused, err := VerifyBinaries(paths)
+		if err != nil {
+			return fmt.Errorf("failed to verify tools: %v", err)
+		}
+		if err := refusedBinariesError(refused); err != nil {
+			return err
+		}
+	}
+
 	for _, tool := range toolsToStart {
 		toolFullPath := GetBinToolsFullPath(tool)
 
@@ -90,46 +211,66 @@ func StartTools(specificTools ...string) error {
 			configPath = Paths.K8sConfig
 		}
 
+		logPath := instanceLogPath(tool, 0)
+		logWriter, err := newRotatingWriter(logPath, getLogConfig(tool))
+		if err != nil {
+			return fmt.Errorf("failed to open log file %s: %v", logPath, err)
+		}
+
 		cmd := exec.Command(toolFullPath, "-c", configPath)
-		fmt.Printf("Starting %s\n", cmd.String())
+		fmt.Printf("Starting %s, logging to %s\n", cmd.String(), logPath)
 		cmd.Dir = Paths.OutputHostBinTools
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		// Tools run in the foreground, so their output is still shown as well.
+		cmd.Stdout = io.MultiWriter(os.Stdout, logWriter)
+		cmd.Stderr = io.MultiWriter(os.Stderr, logWriter)
 
 		if err := cmd.Start(); err != nil {
+			logWriter.Close()
 			return fmt.Errorf("failed to start %s with error: %v", toolFullPath, err)
 		}
 
-		if err := cmd.Wait(); err != nil {
-			return fmt.Errorf("failed to execute %s with exit code: %v", toolFullPath, err)
+		err = cmd.Wait()
+		logWriter.Close()
+		if err != nil {
+			return fmt.Errorf("failed to execute %s with exit code: %v, see %s", toolFullPath, err, logPath)
 		}
 		fmt.Printf("Starting %s successfully \n", cmd.String())
 	}
 	return nil
 }
 
-// KillExistBinaries iterates over all binary files and kills their corresponding processes.
+// KillExistBinaries gracefully stops the processes of all services, killing those that exceed their stop timeout.
 func KillExistBinaries() {
-	var paths []string
+	stopSupervisor()
+	procs, err := serviceProcesses(configuredServices())
+	if err != nil {
+		fmt.Printf("Failed to get processes: %v\n", err)
+		return
+	}
+	stopServiceProcessesInOrder(procs)
+}
+
+// configuredServices returns the services of start-config.yml in a stable order.
+func configuredServices() []string {
+	services := make([]string, 0, len(serviceBinaries))
 	for binary := range serviceBinaries {
-		fullPath := GetBinFullPath(binary)
-		paths = append(paths, fullPath)
+		services = append(services, binary)
 	}
-	BatchKillExistBinaries(paths)
+	slices.Sort(services)
+	return services
 }
 
 // CheckBinariesStop checks if all binary files have stopped and returns an error if there are any binaries still running.
 func CheckBinariesStop() error {
 	var runningBinaries []string
 
-	ps, err := FetchProcesses()
+	procs, err := serviceProcesses(configuredServices())
 	if err != nil {
 		return err
 	}
 
-	for binary := range serviceBinaries {
-		fullPath := GetBinFullPath(binary)
-		if CheckProcessInMap(ps, fullPath) {
+	for _, binary := range configuredServices() {
+		if len(procs[binary]) > 0 {
 			runningBinaries = append(runningBinaries, binary)
 		}
 	}
@@ -143,18 +284,37 @@ func CheckBinariesStop() error {
 
 // CheckBinariesRunning checks if all binary files are running as expected and returns any errors encountered.
 func CheckBinariesRunning() error {
+	return checkInstancesRunning(allInstances())
+}
+
+// checkInstancesRunning checks that the selected instances are running, and that services selected as a whole
+// run exactly their configured count.
+func checkInstancesRunning(selection instanceSelection) error {
 	var errorMessages []string
 
-	ps, err := FetchProcesses()
+	procs, err := selectedProcesses(selection)
 	if err != nil {
 		return err
 	}
 
-	for binary, expectedCount := range serviceBinaries {
-		fullPath := GetBinFullPath(binary)
-		err := CheckProcessNames(fullPath, expectedCount, ps)
-		if err != nil {
-			errorMessages = append(errorMessages, fmt.Sprintf("binary %s is not running as expected: %v", binary, err))
+	state := loadStateOrEmpty()
+	for _, binary := range selection.services() {
+		if selection[binary] != nil {
+			running := make(map[int]bool)
+			for _, p := range procs[binary] {
+				running[processInstanceIndex(state, binary, p)] = true
+			}
+			for _, index := range selection[binary] {
+				if !running[index] {
+					errorMessages = append(errorMessages, fmt.Sprintf("instance %s[%d] is not running: %s", binary, index, GetBinFullPath(binary)))
+				}
+			}
+			continue
+		}
+		expectedCount := serviceBinaries[binary]
+		if runningCount := len(procs[binary]); runningCount != expectedCount {
+			errorMessages = append(errorMessages, fmt.Sprintf("binary %s is not running as expected: %s expected %d processes, but %d running",
+				binary, GetBinFullPath(binary), expectedCount, runningCount))
 		}
 	}
 
@@ -167,14 +327,23 @@ func CheckBinariesRunning() error {
 
 // PrintListenedPortsByBinaries iterates over all binary files and prints the ports they are listening on.
 func PrintListenedPortsByBinaries() error {
-	ps, err := FindPIDsByBinaryPath()
+	return printListenedPorts(allInstances())
+}
+
+// printListenedPorts prints the ports the selected instances are listening on.
+func printListenedPorts(selection instanceSelection) error {
+	procs, err := selectedProcesses(selection)
 	if err != nil {
 		return err
 	}
-	for binary := range serviceBinaries {
-		basePath := GetBinFullPath(binary)
-		fullPath := basePath
-		PrintBinaryPorts(fullPath, ps)
+	ps := make(map[string][]int)
+	for binary, list := range procs {
+		for _, p := range list {
+			ps[GetBinFullPath(binary)] = append(ps[GetBinFullPath(binary)], int(p.Pid))
+		}
+	}
+	for _, binary := range selection.services() {
+		PrintBinaryPorts(GetBinFullPath(binary), ps)
 	}
 	return nil
 }
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package mageutil
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// detachedSysProcAttr starts a process in a new session so it outlives the terminal that started it.
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// sendStopSignal sends the named signal to the process group of a process.
+func sendStopSignal(p *process.Process, signal string) error {
+	return signalProcessGroup(p, stopSignals[signal])
+}
+
+// killProcessGroup kills a process and the other processes of its group.
+func killProcessGroup(p *process.Process) error {
+	return signalProcessGroup(p, syscall.SIGKILL)
+}
+
+// inProcessGroupOf reports whether a process belongs to the process group led by leader.
+func inProcessGroupOf(p *process.Process, leader *process.Process) bool {
+	pgid, err := syscall.Getpgid(int(p.Pid))
+	return err == nil && pgid == int(leader.Pid)
+}
+
+// signalProcessGroup signals the whole group of a process that leads its own group, as instances started with
+// detachedSysProcAttr do, and only the process itself otherwise.
+func signalProcessGroup(p *process.Process, sig syscall.Signal) error {
+	if pgid, err := syscall.Getpgid(int(p.Pid)); err == nil && pgid == int(p.Pid) {
+		return syscall.Kill(-pgid, sig)
+	}
+	return p.SendSignal(sig)
+}
+
+// inheritFiles passes files to the process started by cmd and returns the descriptors they get in it.
+func inheritFiles(cmd *exec.Cmd, files []*os.File) []uintptr {
+	// Extra files follow stdin, stdout and stderr.
+	first := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, files...)
+	fds := make([]uintptr, len(files))
+	for i := range files {
+		fds[i] = uintptr(first + i)
+	}
+	return fds
+}
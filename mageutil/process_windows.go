@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package mageutil
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	createNewProcessGroup = 0x00000200
+	detachedProcess       = 0x00000008
+)
+
+// detachedSysProcAttr starts a process without a console so it outlives the terminal that started it.
+func detachedSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: createNewProcessGroup | detachedProcess}
+}
+
+// sendStopSignal terminates the process, Windows has no signals to ask a process to stop.
+func sendStopSignal(p *process.Process, signal string) error {
+	return p.Terminate()
+}
+
+// inProcessGroupOf reports false, processes on Windows only receive the stop signal themselves.
+func inProcessGroupOf(p *process.Process, leader *process.Process) bool {
+	return false
+}
+
+// killProcessGroup kills the process, its descendants are killed once they are found to remain.
+func killProcessGroup(p *process.Process) error {
+	return p.Kill()
+}
+
+// inheritFiles passes files to the process started by cmd and returns the handles they have in it.
+func inheritFiles(cmd *exec.Cmd, files []*os.File) []uintptr {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	handles := make([]uintptr, len(files))
+	for i, f := range files {
+		h := syscall.Handle(f.Fd())
+		// Inherited handles have to be marked inheritable.
+		syscall.SetHandleInformation(h, syscall.HANDLE_FLAG_INHERIT, syscall.HANDLE_FLAG_INHERIT)
+		cmd.SysProcAttr.AdditionalInheritedHandles = append(cmd.SysProcAttr.AdditionalInheritedHandles, h)
+		handles[i] = uintptr(h)
+	}
+	return handles
+}
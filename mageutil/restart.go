@@ -0,0 +1,187 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// Restart restarts the given services, or all of them, e.g. `mage restart openim-api --rolling`.
+func Restart(args []string) {
+	flags := newFlagSet("restart")
+	rolling := flags.Bool("rolling", false, "restart one instance at a time, waiting for it to be ready")
+	services, err := parseArgs(flags, args)
+	if err != nil {
+		PrintRed("Invalid restart arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	if len(services) == 0 {
+		services = configuredServices()
+	}
+	for i, service := range services {
+		services[i] = withExeSuffix(service)
+		if _, ok := serviceBinaries[services[i]]; !ok {
+			PrintRed(fmt.Sprintf("Service %s is not in start-config.yml", service))
+			os.Exit(1)
+		}
+	}
+	if err := RestartServices(services, *rolling); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+	PrintGreen("Services restarted successfully")
+}
+
+// RestartServices restarts the instances of the given services in dependency order. A rolling restart stops and
+// starts one instance index at a time and aborts, leaving the remaining instances running, when one isn't ready.
+func RestartServices(services []string, rolling bool) error {
+	if sup := runningSupervisor(); sup != nil {
+		return fmt.Errorf("a supervisor is running with pid %d and would restart the instances itself, stop it first", sup.PID)
+	}
+	waves, err := serviceWaves(services)
+	if err != nil {
+		return err
+	}
+	refused, err := verifyServiceBinaries(services)
+	if err != nil {
+		return err
+	}
+	if err := refusedBinariesError(refused); err != nil {
+		return err
+	}
+
+	state, err := LoadState()
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Discarding state file: %v", err))
+		state = &State{}
+	}
+	defer func() {
+		if err := state.Save(); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+		}
+	}()
+
+	for _, wave := range waves {
+		for _, service := range wave {
+			binFullPath := filepath.Join(Paths.OutputHostBin, service)
+			checksum, _, err := fileSHA256(binFullPath)
+			if err != nil {
+				return fmt.Errorf("binary not found: %s, please build first", binFullPath)
+			}
+			procs, err := instanceProcesses(service)
+			if err != nil {
+				return err
+			}
+			count := serviceBinaries[service]
+
+			if !rolling {
+				byService := map[string][]*process.Process{}
+				for _, p := range procs {
+					byService[service] = append(byService[service], p)
+				}
+				stopServiceProcesses(byService)
+				var started []*InstanceState
+				logs := openInstanceLogs(instanceSelection{service: nil})
+				for i := 0; i < count; i++ {
+					_, inst, err := startInstance(service, i, checksum, logs)
+					if err != nil {
+						logs.Close()
+						return err
+					}
+					state.Record(inst)
+					started = append(started, inst)
+				}
+				logs.Close()
+				if err := waitInstancesReady(started, false); err != nil {
+					return err
+				}
+				continue
+			}
+
+			for i := 0; i < count; i++ {
+				PrintBlue(fmt.Sprintf("Restarting %s[%d] (%d/%d)", service, i, i+1, count))
+				if p, ok := procs[i]; ok {
+					stopServiceProcesses(map[string][]*process.Process{service: {p}})
+				}
+				_, inst, err := startInstance(service, i, checksum, nil)
+				if err == nil {
+					state.Record(inst)
+					err = waitInstancesReady([]*InstanceState{inst}, true)
+				}
+				if err != nil {
+					return fmt.Errorf("rolling restart of %s aborted, %s[%d] failed to come back, the remaining instances were left running: %v", service, service, i, err)
+				}
+			}
+			// Instances beyond the configured count are left over from a larger count.
+			for index, p := range procs {
+				if index < 0 || index >= count {
+					stopServiceProcesses(map[string][]*process.Process{service: {p}})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// restartInstance stops instance index of a service, when it is running, starts it again and waits for it to be
+// ready.
+func restartInstance(service string, index int) error {
+	if sup := runningSupervisor(); sup != nil {
+		return fmt.Errorf("a supervisor is running with pid %d and would restart the instance itself, stop it first", sup.PID)
+	}
+	refused, err := verifyServiceBinaries([]string{service})
+	if err != nil {
+		return err
+	}
+	if err := refusedBinariesError(refused); err != nil {
+		return err
+	}
+	binFullPath := filepath.Join(Paths.OutputHostBin, service)
+	checksum, _, err := fileSHA256(binFullPath)
+	if err != nil {
+		return fmt.Errorf("binary not found: %s, please build first", binFullPath)
+	}
+	procs, err := instanceProcesses(service)
+	if err != nil {
+		return err
+	}
+	if p, ok := procs[index]; ok {
+		stopServiceProcesses(map[string][]*process.Process{service: {p}})
+	}
+	_, inst, err := startInstance(service, index, checksum, nil)
+	if err != nil {
+		return err
+	}
+	state := loadStateOrEmpty()
+	state.Record(inst)
+	if err := state.Save(); err != nil {
+		PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+	}
+	return waitInstancesReady([]*InstanceState{inst}, false)
+}
+
+// instanceProcesses returns the running processes of a service by instance index. It scans all processes, unlike
+// serviceProcesses, so that duplicates of recorded instances are found too.
+func instanceProcesses(service string) (map[int]*process.Process, error) {
+	procs, err := scanServiceProcesses([]string{service})
+	if err != nil {
+		return nil, err
+	}
+	state := loadStateOrEmpty()
+	byIndex := make(map[int]*process.Process)
+	unknown := -1
+	for _, p := range procs[service] {
+		index := processInstanceIndex(state, service, p)
+		if _, exists := byIndex[index]; exists || index < 0 {
+			// Keep duplicates and processes without an index under distinct negative keys, so they are stopped too.
+			index = unknown
+			unknown--
+		}
+		byIndex[index] = p
+	}
+	return byIndex, nil
+}
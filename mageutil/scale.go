@@ -0,0 +1,206 @@
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+	"gopkg.in/yaml.v3"
+)
+
+// Scale changes the number of running instances of services, e.g. `mage scale openim-api=2 --save`.
+func Scale(args []string) {
+	flags := newFlagSet("scale")
+	save := flags.Bool("save", false, "write the new counts to start-config.yml")
+	targets, err := parseArgs(flags, args)
+	if err == nil && len(targets) == 0 {
+		err = fmt.Errorf("expected service=count arguments")
+	}
+	if err != nil {
+		PrintRed("Invalid scale arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	counts := make(map[string]int)
+	for _, target := range targets {
+		service, value, ok := strings.Cut(target, "=")
+		count, err := strconv.Atoi(value)
+		if !ok || err != nil || count < 0 {
+			PrintRed(fmt.Sprintf("Invalid scale target %q, expected service=count", target))
+			os.Exit(1)
+		}
+		binary := withExeSuffix(service)
+		if _, ok := serviceBinaries[binary]; !ok {
+			PrintRed(fmt.Sprintf("Service %s is not in start-config.yml", service))
+			os.Exit(1)
+		}
+		counts[binary] = count
+	}
+
+	if err := ScaleServices(counts); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+	if *save {
+		if err := saveServiceCounts(counts); err != nil {
+			PrintRed(fmt.Sprintf("Failed to update %s: %v", countsConfigPath(), err))
+			os.Exit(1)
+		}
+		PrintGreen(fmt.Sprintf("New instance counts written to %s", countsConfigPath()))
+	}
+}
+
+// countsConfigPath returns the file `mage scale --save` writes to.
+func countsConfigPath() string {
+	if env := configEnvironmentName(); env != "" {
+		return overlayConfigPath(env)
+	}
+	return startConfigPath()
+}
+
+// ScaleServices starts the missing instance indexes below the desired count of each service and stops the
+// instances with higher indexes, as well as duplicates and processes whose index is unknown.
+func ScaleServices(counts map[string]int) error {
+	if sup := runningSupervisor(); sup != nil {
+		return fmt.Errorf("a supervisor is running with pid %d and would restart stopped instances, stop it first", sup.PID)
+	}
+	services := make([]string, 0, len(counts))
+	for service := range counts {
+		services = append(services, service)
+	}
+	waves, err := serviceWaves(services)
+	if err != nil {
+		return err
+	}
+	refused, err := verifyServiceBinaries(services)
+	if err != nil {
+		return err
+	}
+	if err := refusedBinariesError(refused); err != nil {
+		return err
+	}
+
+	state, err := LoadState()
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Discarding state file: %v", err))
+		state = &State{}
+	}
+	defer func() {
+		if err := state.Save(); err != nil {
+			PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+		}
+	}()
+
+	for _, wave := range waves {
+		var started []*InstanceState
+		for _, service := range wave {
+			procs, err := instanceProcesses(service)
+			if err != nil {
+				return err
+			}
+			count := counts[service]
+
+			// Unknown indexes have negative keys, they are not counted against the target and stopped first.
+			var surplus []int
+			for index := range procs {
+				if index >= count || index < 0 {
+					surplus = append(surplus, index)
+				}
+			}
+			sort.Slice(surplus, func(i, j int) bool {
+				if (surplus[i] < 0) != (surplus[j] < 0) {
+					return surplus[i] < 0
+				}
+				return surplus[i] > surplus[j]
+			})
+			if len(surplus) > 0 {
+				var stopping []*process.Process
+				for _, index := range surplus {
+					if index < 0 {
+						PrintBlue(fmt.Sprintf("Stopping %s pid %d, a duplicate or without a known instance index", service, procs[index].Pid))
+					} else {
+						PrintBlue(fmt.Sprintf("Stopping %s[%d]", service, index))
+					}
+					stopping = append(stopping, procs[index])
+				}
+				stopServiceProcesses(map[string][]*process.Process{service: stopping})
+			}
+
+			var missing []int
+			for index := 0; index < count; index++ {
+				if _, running := procs[index]; !running {
+					missing = append(missing, index)
+				}
+			}
+			startedBefore := len(started)
+			if len(missing) > 0 {
+				binFullPath := filepath.Join(Paths.OutputHostBin, service)
+				checksum, _, err := fileSHA256(binFullPath)
+				if err != nil {
+					return fmt.Errorf("binary not found: %s, please build first", binFullPath)
+				}
+				logs := openInstanceLogs(instanceSelection{service: missing})
+				for _, index := range missing {
+					_, inst, err := startInstance(service, index, checksum, logs)
+					if err != nil {
+						logs.Close()
+						return err
+					}
+					state.Record(inst)
+					started = append(started, inst)
+				}
+				logs.Close()
+			}
+			PrintGreen(fmt.Sprintf("%s scaled to %d instances (started %d, stopped %d)", service, count, len(started)-startedBefore, len(surplus)))
+		}
+		if err := waitInstancesReady(started, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveServiceCounts writes instance counts to start-config.yml, or to the overlay of the selected environment,
+// keeping the shorthand or mapping form of each entry. Services missing from an overlay are added to it.
+func saveServiceCounts(counts map[string]int) error {
+	path := countsConfigPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	doc, err := parseStartConfigNode(data)
+	if err != nil {
+		return err
+	}
+	serviceNode := ensureChildNode(doc.Content[0], "serviceBinaries", yaml.MappingNode)
+	for binary, count := range counts {
+		name := strings.TrimSuffix(binary, ".exe")
+		value := strconv.Itoa(count)
+		found := false
+		for i := 0; i+1 < len(serviceNode.Content); i += 2 {
+			if serviceNode.Content[i].Value != name {
+				continue
+			}
+			found = true
+			entry := serviceNode.Content[i+1]
+			if entry.Kind == yaml.MappingNode {
+				countNode := ensureChildNode(entry, "count", yaml.ScalarNode)
+				countNode.Tag, countNode.Value = "!!int", value
+			} else {
+				entry.Kind, entry.Tag, entry.Value = yaml.ScalarNode, "!!int", value
+			}
+		}
+		if !found && configEnvironmentName() != "" {
+			serviceNode.Content = append(serviceNode.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: value})
+		} else if !found {
+			return fmt.Errorf("service %s not found in %s", name, path)
+		}
+	}
+	return writeStartConfigNode(path, doc)
+}
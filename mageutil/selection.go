@@ -0,0 +1,134 @@
+package mageutil
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// instanceSelection holds the instances named on the command line as `service` or `service:index`. A service
+// mapped to nil is selected with all its instances.
+type instanceSelection map[string][]int
+
+// allInstances selects every instance of the configured services.
+func allInstances() instanceSelection {
+	s := make(instanceSelection)
+	for _, service := range configuredServices() {
+		s[service] = nil
+	}
+	return s
+}
+
+// parseInstanceSelection parses `service` and `service:index` targets, no target selects every instance.
+func parseInstanceSelection(targets []string) (instanceSelection, error) {
+	if len(targets) == 0 {
+		return allInstances(), nil
+	}
+	s := make(instanceSelection)
+	whole := make(map[string]bool)
+	for _, target := range targets {
+		name, index, hasIndex := strings.Cut(target, ":")
+		service := withExeSuffix(name)
+		count, ok := serviceBinaries[service]
+		if !ok {
+			return nil, fmt.Errorf("service %s is not in start-config.yml", name)
+		}
+		if !hasIndex {
+			whole[service] = true
+			s[service] = nil
+			continue
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid instance index in %q", target)
+		}
+		if n >= count {
+			return nil, fmt.Errorf("%s has %d instances in start-config.yml, there is no instance %d", name, count, n)
+		}
+		if !whole[service] && !slices.Contains(s[service], n) {
+			s[service] = append(s[service], n)
+		}
+	}
+	for _, indexes := range s {
+		slices.Sort(indexes)
+	}
+	return s, nil
+}
+
+// services returns the selected services in a stable order.
+func (s instanceSelection) services() []string {
+	services := make([]string, 0, len(s))
+	for service := range s {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	return services
+}
+
+// includes reports whether instance index of a service is selected.
+func (s instanceSelection) includes(service string, index int) bool {
+	indexes, ok := s[service]
+	return ok && (indexes == nil || slices.Contains(indexes, index))
+}
+
+// indexes returns the selected instance indexes of a service.
+func (s instanceSelection) indexes(service string) []int {
+	if indexes := s[service]; indexes != nil {
+		return indexes
+	}
+	indexes := make([]int, serviceBinaries[service])
+	for i := range indexes {
+		indexes[i] = i
+	}
+	return indexes
+}
+
+// complete reports whether every configured instance is selected.
+func (s instanceSelection) complete() bool {
+	for _, service := range configuredServices() {
+		if indexes, ok := s[service]; !ok || indexes != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (s instanceSelection) String() string {
+	var names []string
+	for _, service := range s.services() {
+		if s[service] == nil {
+			names = append(names, service)
+			continue
+		}
+		for _, index := range s[service] {
+			names = append(names, fmt.Sprintf("%s[%d]", service, index))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// selectedProcesses returns the running processes of the selected instances by service. A service selected as a
+// whole also gets the processes without a known index or beyond its configured count.
+func selectedProcesses(s instanceSelection) (map[string][]*process.Process, error) {
+	procs, err := serviceProcesses(s.services())
+	if err != nil {
+		return nil, err
+	}
+	state := loadStateOrEmpty()
+	for service, list := range procs {
+		if s[service] == nil {
+			continue
+		}
+		var selected []*process.Process
+		for _, p := range list {
+			if s.includes(service, processInstanceIndex(state, service, p)) {
+				selected = append(selected, p)
+			}
+		}
+		procs[service] = selected
+	}
+	return procs, nil
+}
@@ -0,0 +1,174 @@
+package mageutil
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Restart policies for supervised services.
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// ServiceConfig is the configuration of one service in start-config.yml. It is written either
+// as the `name: count` shorthand or as a mapping:
+//
+//	openim-api:
+//	  count: 2
+//	  restart:
+//	    policy: on-failure
+//	    maxRestarts: 5
+type ServiceConfig struct {
+	Count     int           `yaml:"count"`
+	DependsOn []string      `yaml:"dependsOn"` // Services started before, and stopped after, this one
+	Restart   RestartConfig `yaml:"restart"`
+	Logs      *LogConfig    `yaml:"logs"` // Overrides the top-level logs section
+	Stop      StopConfig    `yaml:"stop"`
+	Probes    ProbesConfig  `yaml:"probes"`
+	Limits    LimitsConfig  `yaml:"limits"`
+
+	// The fields below are templates, see InstanceTemplateData.
+	ArgTemplate []string          `yaml:"argTemplate"` // Replaces the default `-i {{.Index}} -c {{.ConfigDir}}`
+	Args        []string          `yaml:"args"`        // Appended to the arguments
+	Env         map[string]string `yaml:"env"`
+	WorkDir     string            `yaml:"workDir"` // Relative to the project root, default the binary directory
+	Port        PortConfig        `yaml:"port"`    // Base port, list of ports or auto, the port is {{.Port}}
+}
+
+// RestartConfig controls how `mage supervise` restarts crashed instances.
+type RestartConfig struct {
+	Policy      string        `yaml:"policy"`      // always, on-failure (default) or never
+	MaxRestarts int           `yaml:"maxRestarts"` // Restarts allowed per instance within Window, 0 means unlimited
+	Window      time.Duration `yaml:"window"`      // Period over which MaxRestarts is counted, default 10m
+	Backoff     time.Duration `yaml:"backoff"`     // Delay before the first restart, default 1s
+	MaxBackoff  time.Duration `yaml:"maxBackoff"`  // Upper bound of the exponential backoff, default 1m
+}
+
+// StopConfig controls how instances are stopped, they are killed when they don't exit within Timeout.
+type StopConfig struct {
+	Signal  string         `yaml:"signal"`  // SIGTERM (default), SIGINT, SIGQUIT, SIGHUP, SIGUSR1 or SIGUSR2, ignored on Windows
+	Timeout time.Duration  `yaml:"timeout"` // Grace period before the instance is killed, default 15s
+	PreStop *PreStopConfig `yaml:"preStop"`
+}
+
+// PreStopConfig is an HTTP call made before the stop signal is sent, e.g. to drain connections.
+type PreStopConfig struct {
+	URL     string        `yaml:"url"`     // Template like the probe settings, e.g. http://127.0.0.1:{{.Port}}/drain
+	Method  string        `yaml:"method"`  // Default POST
+	Timeout time.Duration `yaml:"timeout"` // Default 5s, counts towards the stop timeout
+}
+
+var stopSignalNames = []string{"SIGTERM", "SIGINT", "SIGQUIT", "SIGHUP", "SIGUSR1", "SIGUSR2"}
+
+func (s *ServiceConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&s.Count)
+	}
+	type plain ServiceConfig
+	cfg := plain{Count: 1}
+	if err := value.Decode(&cfg); err != nil {
+		return err
+	}
+	*s = ServiceConfig(cfg)
+	return nil
+}
+
+// withDefaults returns a copy of the config with unset values replaced by their defaults.
+func (s ServiceConfig) withDefaults() ServiceConfig {
+	if s.Restart.Policy == "" {
+		s.Restart.Policy = RestartOnFailure
+	}
+	if s.Restart.Window <= 0 {
+		s.Restart.Window = 10 * time.Minute
+	}
+	if s.Restart.Backoff <= 0 {
+		s.Restart.Backoff = time.Second
+	}
+	if s.Restart.MaxBackoff <= 0 {
+		s.Restart.MaxBackoff = time.Minute
+	}
+	if s.Restart.MaxBackoff < s.Restart.Backoff {
+		s.Restart.MaxBackoff = s.Restart.Backoff
+	}
+	s.Stop.Signal = normalizeSignalName(s.Stop.Signal)
+	if s.Stop.Signal == "" {
+		s.Stop.Signal = "SIGTERM"
+	}
+	if s.Stop.Timeout <= 0 {
+		s.Stop.Timeout = 15 * time.Second
+	}
+	if s.Stop.PreStop != nil {
+		preStop := *s.Stop.PreStop
+		if preStop.Method == "" {
+			preStop.Method = http.MethodPost
+		}
+		if preStop.Timeout <= 0 {
+			preStop.Timeout = 5 * time.Second
+		}
+		s.Stop.PreStop = &preStop
+	}
+	return s
+}
+
+// normalizeSignalName accepts signal names in any case and without the SIG prefix, e.g. "term".
+func normalizeSignalName(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name != "" && !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	return name
+}
+
+func (s ServiceConfig) validate() error {
+	switch s.Restart.Policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		return fmt.Errorf("invalid restart policy %q, expected %s, %s or %s", s.Restart.Policy, RestartAlways, RestartOnFailure, RestartNever)
+	}
+	if signal := normalizeSignalName(s.Stop.Signal); signal != "" && !slices.Contains(stopSignalNames, signal) {
+		return fmt.Errorf("unsupported stop signal %q, expected one of %s", s.Stop.Signal, strings.Join(stopSignalNames, ", "))
+	}
+	if s.Stop.PreStop != nil {
+		if s.Stop.PreStop.URL == "" {
+			return fmt.Errorf("stop.preStop requires a url")
+		}
+		if _, err := expandInstance("preStop url", s.Stop.PreStop.URL, InstanceTemplateData{}); err != nil {
+			return err
+		}
+	}
+	if _, err := s.launchSpec(InstanceTemplateData{}); err != nil {
+		return err
+	}
+	if err := s.Port.validate(); err != nil {
+		return err
+	}
+	if err := s.Limits.validate(); err != nil {
+		return err
+	}
+	if s.Probes.Readiness != nil {
+		if err := s.Probes.Readiness.validate(); err != nil {
+			return fmt.Errorf("probes.readiness: %v", err)
+		}
+	}
+	if s.Probes.Liveness != nil {
+		if err := s.Probes.Liveness.validate(); err != nil {
+			return fmt.Errorf("probes.liveness: %v", err)
+		}
+	}
+	return nil
+}
+
+// getServiceConfig returns the effective configuration of a service, services missing from start-config.yml get the defaults.
+func getServiceConfig(binary string) ServiceConfig {
+	if cfg, ok := serviceConfigs[binary]; ok && cfg != nil {
+		return cfg.withDefaults()
+	}
+	return ServiceConfig{Count: 1}.withDefaults()
+}
@@ -0,0 +1,242 @@
+package mageutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// StateFile records the instances launched by gomake, it lives in Paths.OutputTmp.
+const StateFile = "instances.json"
+
+// InstanceState describes one launched service instance.
+type InstanceState struct {
+	Service   string    `json:"service"`
+	Index     int       `json:"index"`
+	PID       int       `json:"pid"`
+	StartTime time.Time `json:"startTime"` // Process creation time, used to detect PID reuse, zero when unknown
+	Args      []string  `json:"args"`
+	Binary    string    `json:"binary"`
+	Checksum  string    `json:"checksum"`
+	Port      int       `json:"port,omitempty"`
+	Restarts  int       `json:"restarts"` // Number of times the supervisor restarted this instance
+}
+
+// State is the content of the state file.
+type State struct {
+	Instances []*InstanceState `json:"instances"`
+}
+
+func stateFilePath() string {
+	return filepath.Join(Paths.OutputTmp, StateFile)
+}
+
+// LoadState reads the state file, a missing file yields an empty state.
+func LoadState() (*State, error) {
+	data, err := os.ReadFile(stateFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &State{}, nil
+		}
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid state file %s: %w", stateFilePath(), err)
+	}
+	return &state, nil
+}
+
+// Save drops the instances that are no longer running and writes the state file atomically.
+func (s *State) Save() error {
+	s.Prune()
+	sort.SliceStable(s.Instances, func(i, j int) bool {
+		if s.Instances[i].Service != s.Instances[j].Service {
+			return s.Instances[i].Service < s.Instances[j].Service
+		}
+		return s.Instances[i].Index < s.Instances[j].Index
+	})
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := stateFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Prune removes the instances whose process has exited.
+func (s *State) Prune() {
+	alive := s.Instances[:0]
+	for _, inst := range s.Instances {
+		if inst.Process() != nil {
+			alive = append(alive, inst)
+		}
+	}
+	s.Instances = alive
+}
+
+// Record adds a launched instance, replacing any previous record of the same service index.
+func (s *State) Record(inst *InstanceState) {
+	for i, existing := range s.Instances {
+		if existing.Service == inst.Service && existing.Index == inst.Index {
+			s.Instances[i] = inst
+			return
+		}
+	}
+	s.Instances = append(s.Instances, inst)
+}
+
+// InstancesOf returns the recorded instances of a service.
+func (s *State) InstancesOf(service string) []*InstanceState {
+	var instances []*InstanceState
+	for _, inst := range s.Instances {
+		if inst.Service == service {
+			instances = append(instances, inst)
+		}
+	}
+	return instances
+}
+
+// Process returns the running process of the instance, or nil when it has exited or its PID was reused.
+func (inst *InstanceState) Process() *process.Process {
+	p, err := process.NewProcess(int32(inst.PID))
+	if err != nil {
+		return nil
+	}
+	// An exited child that was not reaped yet still has a PID.
+	if status, err := p.Status(); err == nil && status == "Z" {
+		return nil
+	}
+	if createTime, err := p.CreateTime(); err == nil && !inst.StartTime.IsZero() {
+		if createTime != inst.StartTime.UnixMilli() {
+			return nil
+		}
+		return p
+	}
+	// The creation time is not always readable, fall back to the executable path.
+	if exe, err := p.Exe(); err != nil || exe != inst.Binary {
+		return nil
+	}
+	return p
+}
+
+// newInstanceState describes a just started process. Its start time is left zero when the creation time of the
+// process can't be read, the time of the call would never match it.
+func newInstanceState(service string, index, pid int, binary, checksum string, args []string) *InstanceState {
+	var startTime time.Time
+	if p, err := process.NewProcess(int32(pid)); err == nil {
+		if createTime, err := p.CreateTime(); err == nil {
+			startTime = time.UnixMilli(createTime)
+		}
+	}
+	return &InstanceState{
+		Service:   service,
+		Index:     index,
+		PID:       pid,
+		StartTime: startTime,
+		Args:      args,
+		Binary:    binary,
+		Checksum:  checksum,
+	}
+}
+
+// serviceProcesses returns the running processes of each service. The instances recorded in the state file are
+// checked first, the processes of the system are only scanned when a service has fewer live recorded instances
+// than configured, see scanServiceProcesses.
+func serviceProcesses(services []string) (map[string][]*process.Process, error) {
+	state, err := LoadState()
+	if err != nil {
+		return scanServiceProcesses(services)
+	}
+	result := make(map[string][]*process.Process)
+	for _, service := range services {
+		for _, inst := range state.InstancesOf(service) {
+			p := inst.Process()
+			if p == nil {
+				continue
+			}
+			if marker, _ := readInstanceMarker(p); marker != nil && marker.service != service {
+				continue
+			}
+			result[service] = append(result[service], p)
+		}
+		if len(result[service]) < serviceBinaries[service] {
+			return scanServiceProcesses(services)
+		}
+	}
+	return result, nil
+}
+
+// scanServiceProcesses returns the running processes of each service among all processes of the system. Processes
+// are identified by the marker in their environment; instances recorded in the state file without a marker,
+// launched by an older gomake, are recognized from it, and processes whose environment can't be read fall back to
+// the executable path.
+func scanServiceProcesses(services []string) (map[string][]*process.Process, error) {
+	state, err := LoadState()
+	if err != nil {
+		PrintYellow(fmt.Sprintf("Ignoring state file: %v", err))
+		state = &State{}
+	}
+	processes, err := process.Processes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processes: %v", err)
+	}
+	marked, unreadable := markedProcesses(processes)
+	exePathMap := make(map[string][]*process.Process)
+	for _, p := range unreadable {
+		exePath, err := p.Exe()
+		if err != nil {
+			continue // Skip processes where the executable path cannot be determined
+		}
+		exePathMap[exePath] = append(exePathMap[exePath], p)
+	}
+
+	result := make(map[string][]*process.Process)
+	for _, service := range services {
+		seen := make(map[int32]bool)
+		add := func(p *process.Process) {
+			if !seen[p.Pid] {
+				seen[p.Pid] = true
+				result[service] = append(result[service], p)
+			}
+		}
+		for _, p := range marked[service] {
+			add(p)
+		}
+		for _, inst := range state.InstancesOf(service) {
+			if p := inst.Process(); p != nil {
+				if marker, _ := readInstanceMarker(p); marker == nil {
+					add(p)
+				}
+			}
+		}
+		for _, p := range exePathMap[GetBinFullPath(service)] {
+			add(p)
+		}
+	}
+	return result, nil
+}
+
+// pruneStateFile drops exited instances from the state file.
+func pruneStateFile() {
+	state, err := LoadState()
+	if err != nil {
+		return
+	}
+	if err := state.Save(); err != nil {
+		PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+	}
+}
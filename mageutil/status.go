@@ -0,0 +1,325 @@
+package mageutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+)
+
+// Health values of InstanceStatus.
+const (
+	HealthHealthy    = "healthy"
+	HealthUnhealthy  = "unhealthy"
+	HealthUnknown    = "unknown" // The service has no probe
+	HealthNotRunning = "not running"
+)
+
+// cpuSampleInterval is how long a single `mage status` measures CPU usage.
+const cpuSampleInterval = 500 * time.Millisecond
+
+// InstanceStatus is one row of `mage status`. Missing values are -1.
+type InstanceStatus struct {
+	Service       string    `json:"service"`
+	Index         int       `json:"index"`
+	PID           int32     `json:"pid"`
+	StartTime     time.Time `json:"startTime,omitempty"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	CPUPercent    float64   `json:"cpuPercent"`
+	RSSBytes      int64     `json:"rssBytes"`
+	OpenFDs       int32     `json:"openFDs"`
+	FDLimit       int64     `json:"fdLimit,omitempty"` // Soft open files limit, 0 when unlimited or unknown
+	Threads       int32     `json:"threads"`
+	Connections   int       `json:"connections"`
+	Ports         []uint32  `json:"ports"`
+	Restarts      int       `json:"restarts"`
+	Health        string    `json:"health"`
+	HealthError   string    `json:"healthError,omitempty"`
+
+	process *process.Process
+}
+
+// Status prints the instances of all services, e.g. `mage status --json` or `mage status --watch`.
+func Status(args []string) {
+	flags := newFlagSet("status")
+	asJSON := flags.Bool("json", false, "print JSON instead of a table")
+	watch := flags.Bool("watch", false, "refresh until interrupted")
+	interval := flags.Duration("interval", 2*time.Second, "refresh interval of --watch")
+	if _, err := parseArgs(flags, args); err != nil {
+		PrintRed("Invalid status arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	sampler := newCPUSampler()
+	for {
+		statuses, err := collectInstanceStatuses(sampler, true)
+		if err != nil {
+			PrintRed(err.Error())
+			os.Exit(1)
+		}
+		if *asJSON {
+			// One document per line in watch mode, so scripts can read a stream.
+			encoder := json.NewEncoder(os.Stdout)
+			if !*watch {
+				encoder.SetIndent("", "  ")
+			}
+			if err := encoder.Encode(statuses); err != nil {
+				PrintRed(err.Error())
+				os.Exit(1)
+			}
+		} else {
+			if *watch {
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("%s, every %s\n\n", time.Now().Format(time.DateTime), *interval)
+			}
+			printStatusTable(statuses)
+		}
+		if !*watch {
+			return
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// collectInstanceStatuses returns the status of every configured instance, including the ones that are not
+// running, ordered by service and index. The first collection with a sampler measures CPU usage over
+// cpuSampleInterval, later ones since the previous collection.
+func collectInstanceStatuses(sampler *cpuSampler, withHealth bool) ([]*InstanceStatus, error) {
+	services := configuredServices()
+	procs, err := serviceProcesses(services)
+	if err != nil {
+		return nil, err
+	}
+	state := loadStateOrEmpty()
+
+	var statuses []*InstanceStatus
+	for _, service := range services {
+		running := make(map[int]bool)
+		for _, p := range procs[service] {
+			index := processInstanceIndex(state, service, p)
+			running[index] = true
+			status := &InstanceStatus{Service: service, Index: index, PID: p.Pid, Health: HealthUnknown, process: p}
+			for _, inst := range state.InstancesOf(service) {
+				if int32(inst.PID) == p.Pid {
+					status.Restarts = inst.Restarts
+				}
+			}
+			statuses = append(statuses, status)
+		}
+		for index := 0; index < serviceBinaries[service]; index++ {
+			if !running[index] {
+				statuses = append(statuses, &InstanceStatus{Service: service, Index: index, PID: -1, Health: HealthNotRunning})
+			}
+		}
+	}
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if statuses[i].Service != statuses[j].Service {
+			return statuses[i].Service < statuses[j].Service
+		}
+		return statuses[i].Index < statuses[j].Index
+	})
+
+	if !sampler.primed {
+		sampler.primed = true
+		for _, s := range statuses {
+			if s.process != nil {
+				sampler.percent(s.process)
+			}
+		}
+		if len(sampler.samples) > 0 {
+			time.Sleep(cpuSampleInterval)
+		}
+	}
+	var wg sync.WaitGroup
+	for _, s := range statuses {
+		if s.process == nil {
+			s.UptimeSeconds, s.CPUPercent, s.RSSBytes, s.OpenFDs, s.Threads = -1, -1, -1, -1, -1
+			continue
+		}
+		s.fillResources(sampler)
+		probe := livenessProbe(s.Service)
+		if !withHealth || probe == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(s *InstanceStatus) {
+			defer wg.Done()
+			if err := probe.run(newInstanceTemplateData(s.Service, s.Index, instancePort(state, s.Service, s.Index))); err != nil {
+				s.Health, s.HealthError = HealthUnhealthy, err.Error()
+			} else {
+				s.Health = HealthHealthy
+			}
+		}(s)
+	}
+	wg.Wait()
+	sampler.forgetExcept(statuses)
+	return statuses, nil
+}
+
+// fillResources reads the resource usage of a running instance, values that can't be read stay -1.
+func (s *InstanceStatus) fillResources(sampler *cpuSampler) {
+	p := s.process
+	s.UptimeSeconds, s.RSSBytes, s.OpenFDs, s.Threads = -1, -1, -1, -1
+	if created, err := p.CreateTime(); err == nil {
+		s.StartTime = time.UnixMilli(created)
+		s.UptimeSeconds = int64(time.Since(s.StartTime).Seconds())
+	}
+	s.CPUPercent = sampler.percent(p)
+	if mem, err := p.MemoryInfo(); err == nil {
+		s.RSSBytes = int64(mem.RSS)
+	}
+	if fds, err := p.NumFDs(); err == nil {
+		s.OpenFDs = fds
+	}
+	if limits, err := p.Rlimit(); err == nil {
+		for _, limit := range limits {
+			if limit.Resource == process.RLIMIT_NOFILE && limit.Soft > 0 {
+				s.FDLimit = int64(limit.Soft)
+			}
+		}
+	}
+	if threads, err := p.NumThreads(); err == nil {
+		s.Threads = threads
+	}
+	s.Ports = []uint32{}
+	if conns, err := net.ConnectionsPid("inet", p.Pid); err == nil {
+		seen := make(map[uint32]bool)
+		for _, conn := range conns {
+			if conn.Status == "LISTEN" && !seen[conn.Laddr.Port] {
+				seen[conn.Laddr.Port] = true
+				s.Ports = append(s.Ports, conn.Laddr.Port)
+			} else if conn.Status != "LISTEN" && conn.Raddr.Port != 0 {
+				s.Connections++
+			}
+		}
+		sort.Slice(s.Ports, func(i, j int) bool { return s.Ports[i] < s.Ports[j] })
+	}
+}
+
+func printStatusTable(statuses []*InstanceStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tINDEX\tPID\tUPTIME\tCPU%\tRSS\tFDS\tTHREADS\tPORTS\tRESTARTS\tHEALTH")
+	for _, s := range statuses {
+		if s.process == nil {
+			fmt.Fprintf(w, "%s\t%d\t-\t-\t-\t-\t-\t-\t-\t-\t%s\n", s.Service, s.Index, s.Health)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Service, s.Index, s.PID,
+			formatUptime(s.UptimeSeconds), formatPercent(s.CPUPercent), formatBytes(s.RSSBytes),
+			formatCount(s.OpenFDs), formatCount(s.Threads), formatPorts(s.Ports), s.Restarts, s.Health)
+	}
+	w.Flush()
+}
+
+func formatUptime(seconds int64) string {
+	if seconds < 0 {
+		return "-"
+	}
+	d := time.Duration(seconds) * time.Second
+	if days := d / (24 * time.Hour); days > 0 {
+		return fmt.Sprintf("%dd%s", days, strings.TrimSuffix((d%(24*time.Hour)).Truncate(time.Minute).String(), "0s"))
+	}
+	return d.String()
+}
+
+func formatPercent(percent float64) string {
+	if percent < 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(percent, 'f', 1, 64)
+}
+
+func formatBytes(n int64) string {
+	if n < 0 {
+		return "-"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n)/unit, "KMGT"
+	for i := 0; ; i++ {
+		if value < unit || i == len(suffix)-1 {
+			return fmt.Sprintf("%.1f%ciB", value, suffix[i])
+		}
+		value /= unit
+	}
+}
+
+func formatCount(n int32) string {
+	if n < 0 {
+		return "-"
+	}
+	return strconv.Itoa(int(n))
+}
+
+func formatPorts(ports []uint32) string {
+	if len(ports) == 0 {
+		return "-"
+	}
+	values := make([]string, len(ports))
+	for i, port := range ports {
+		values[i] = strconv.Itoa(int(port))
+	}
+	return strings.Join(values, ",")
+}
+
+// cpuSampler computes the CPU usage of processes between two samples.
+type cpuSampler struct {
+	mu      sync.Mutex
+	samples map[int32]cpuSample
+	primed  bool // Whether the first sample was taken
+}
+
+type cpuSample struct {
+	total float64 // User and system CPU seconds
+	at    time.Time
+}
+
+func newCPUSampler() *cpuSampler {
+	return &cpuSampler{samples: make(map[int32]cpuSample)}
+}
+
+// percent returns the CPU usage of a process since its previous sample, 100 per busy core, or -1 when there is no
+// previous sample.
+func (c *cpuSampler) percent(p *process.Process) float64 {
+	times, err := p.Times()
+	if err != nil {
+		return -1
+	}
+	now := time.Now()
+	sample := cpuSample{total: times.User + times.System, at: now}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.samples[p.Pid]
+	c.samples[p.Pid] = sample
+	if !ok || !now.After(prev.at) || sample.total < prev.total {
+		return -1
+	}
+	return (sample.total - prev.total) / now.Sub(prev.at).Seconds() * 100
+}
+
+// forgetExcept drops the samples of processes that are no longer listed.
+func (c *cpuSampler) forgetExcept(statuses []*InstanceStatus) {
+	keep := make(map[int32]bool)
+	for _, s := range statuses {
+		keep[s.PID] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pid := range c.samples {
+		if !keep[pid] {
+			delete(c.samples, pid)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package mageutil
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+const stopPollInterval = 100 * time.Millisecond
+
+// stopServiceProcesses gracefully stops the processes of each service concurrently, using the stop config of the
+// service, and reports the instances that had to be killed. It returns once every process has exited.
+func stopServiceProcesses(procs map[string][]*process.Process) []string {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		killed []string
+	)
+	for service, ps := range procs {
+		cfg := getServiceConfig(service)
+		for _, p := range ps {
+			wg.Add(1)
+			go func(service string, p *process.Process) {
+				defer wg.Done()
+				if stopProcess(service, p, cfg.Stop) {
+					mu.Lock()
+					killed = append(killed, fmt.Sprintf("%s (pid %d)", service, p.Pid))
+					mu.Unlock()
+				}
+			}(service, p)
+		}
+	}
+	wg.Wait()
+
+	if len(killed) > 0 {
+		slices.Sort(killed)
+		PrintRed("The following instances did not stop within their grace period and were killed: " + strings.Join(killed, ", "))
+	}
+	return killed
+}
+
+// stopProcess runs the pre-stop call, sends the stop signal to the process group and kills the group when the
+// process or one of its descendants is still running after the timeout. Descendants that remain once the group is
+// gone, e.g. because they left it, are reported and killed. It reports whether the process had to be killed.
+func stopProcess(service string, p *process.Process, cfg StopConfig) bool {
+	deadline := time.Now().Add(cfg.Timeout)
+	args, _ := p.CmdlineSlice()
+	cmdline := strings.Join(args, " ")
+	tree := newProcessTree(p)
+	defer tree.killStragglers(service)
+
+	if cfg.PreStop != nil {
+		state := loadStateOrEmpty()
+		index := processInstanceIndex(state, service, p)
+		data := newInstanceTemplateData(service, index, instancePort(state, service, index))
+		if err := callPreStop(cfg.PreStop, data, time.Until(deadline)); err != nil {
+			PrintYellow(fmt.Sprintf("Pre-stop call of %s pid %d failed: %v", service, p.Pid, err))
+		}
+	}
+
+	if err := sendStopSignal(p, cfg.Signal); err != nil {
+		if processExited(p) {
+			return false
+		}
+		fmt.Printf("Failed to send %s to process cmdline: %s, pid: %d, err: %v\n", cfg.Signal, cmdline, p.Pid, err)
+	} else {
+		fmt.Printf("Sent %s to process cmdline: %s, pid: %d\n", cfg.Signal, cmdline, p.Pid)
+		for time.Now().Before(deadline) {
+			if tree.exited() {
+				return false
+			}
+			time.Sleep(stopPollInterval)
+		}
+		if processExited(p) {
+			// Only descendants are left, they are killed as stragglers.
+			return false
+		}
+	}
+
+	tree.refresh()
+	if err := killProcessGroup(p); err != nil {
+		if processExited(p) {
+			return false
+		}
+		PrintRed(fmt.Sprintf("Failed to kill process cmdline: %s, pid: %d, err: %v", cmdline, p.Pid, err))
+		return false
+	}
+	fmt.Printf("Killed process cmdline: %s, pid: %d\n", cmdline, p.Pid)
+	// SIGKILL is delivered asynchronously, wait briefly so callers don't see the killed process as still running.
+	for i := 0; i < 20 && !processExited(p); i++ {
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
+
+// processTree tracks the descendants of a process, which are re-parented once it exits and can then no longer be
+// found through it.
+type processTree struct {
+	root        *process.Process
+	descendants map[int32]trackedProcess
+}
+
+// trackedProcess is a process with its creation time, which tells it apart from a later process reusing its pid.
+type trackedProcess struct {
+	process *process.Process
+	created int64
+	grouped bool // In the process group of the root, so it received the stop signal too
+}
+
+func newProcessTree(root *process.Process) *processTree {
+	t := &processTree{root: root, descendants: make(map[int32]trackedProcess)}
+	t.refresh()
+	return t
+}
+
+// refresh adds the current descendants of the root while it is still running.
+func (t *processTree) refresh() {
+	if processExited(t.root) {
+		return
+	}
+	queue := []*process.Process{t.root}
+	for len(queue) > 0 {
+		children, _ := queue[0].Children()
+		queue = queue[1:]
+		for _, child := range children {
+			if _, seen := t.descendants[child.Pid]; seen {
+				continue
+			}
+			created, err := child.CreateTime()
+			if err != nil {
+				continue
+			}
+			t.descendants[child.Pid] = trackedProcess{process: child, created: created, grouped: inProcessGroupOf(child, t.root)}
+			queue = append(queue, child)
+		}
+	}
+}
+
+// exited reports whether the root and the known descendants that received the stop signal have exited.
+func (t *processTree) exited() bool {
+	t.refresh()
+	if !processExited(t.root) {
+		return false
+	}
+	for _, d := range t.remaining() {
+		if d.grouped {
+			return false
+		}
+	}
+	return true
+}
+
+// remaining returns the descendants that are still running.
+func (t *processTree) remaining() []trackedProcess {
+	var remaining []trackedProcess
+	for _, d := range t.descendants {
+		if processExited(d.process) {
+			continue
+		}
+		if created, err := d.process.CreateTime(); err != nil || created != d.created {
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+	return remaining
+}
+
+// killStragglers kills and reports the descendants that are still running after the root exited.
+func (t *processTree) killStragglers(service string) {
+	remaining := t.remaining()
+	if len(remaining) == 0 {
+		return
+	}
+	var stragglers []string
+	for _, d := range remaining {
+		cmdline, _ := d.process.Cmdline()
+		stragglers = append(stragglers, fmt.Sprintf("pid %d (%s)", d.process.Pid, cmdline))
+		if err := d.process.Kill(); err != nil && !processExited(d.process) {
+			PrintRed(fmt.Sprintf("Failed to kill process pid: %d, err: %v", d.process.Pid, err))
+		}
+	}
+	slices.Sort(stragglers)
+	PrintYellow(fmt.Sprintf("Processes spawned by %s pid %d were still running after it stopped and were killed: %s", service, t.root.Pid, strings.Join(stragglers, ", ")))
+}
+
+// callPreStop makes the pre-stop HTTP call of an instance, bounded by the remaining stop timeout.
+func callPreStop(cfg *PreStopConfig, data InstanceTemplateData, remaining time.Duration) error {
+	timeout := cfg.Timeout
+	if remaining < timeout {
+		timeout = remaining
+	}
+	url, err := expandInstance("preStop url", cfg.URL, data)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(cfg.Method, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s", cfg.Method, url, resp.Status)
+	}
+	return nil
+}
+
+// instanceIndexFromArgs returns the value of the -i argument of a service command line, or -1.
+func instanceIndexFromArgs(args []string) int {
+	for i, arg := range args {
+		if arg == "-i" && i+1 < len(args) {
+			if index, err := strconv.Atoi(args[i+1]); err == nil {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+// processExited reports whether a process is gone or only waits to be reaped.
+func processExited(p *process.Process) bool {
+	running, err := p.IsRunning()
+	if err != nil || !running {
+		return true
+	}
+	status, err := p.Status()
+	return err == nil && status == "Z"
+}
+
+// maxStopTimeout returns the longest stop timeout of the configured services.
+func maxStopTimeout() time.Duration {
+	longest := getServiceConfig("").Stop.Timeout
+	for binary := range serviceBinaries {
+		if timeout := getServiceConfig(binary).Stop.Timeout; timeout > longest {
+			longest = timeout
+		}
+	}
+	return longest
+}
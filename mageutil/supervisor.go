@@ -0,0 +1,418 @@
+package mageutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	SupervisorPidFile = "supervisor.pid"
+	SupervisorLogFile = "supervisor.log"
+
+	// supervisorStopMargin is added to the longest stop timeout when waiting for the supervisor to stop its instances.
+	supervisorStopMargin = 5 * time.Second
+)
+
+type supervisedInstance struct {
+	service  string
+	index    int
+	config   ServiceConfig
+	checksum string
+	cmd      *exec.Cmd
+	started  time.Time
+	backoff  time.Duration
+	restarts []time.Time // Restarts within the budget window
+	total    int
+}
+
+type instanceExit struct {
+	inst *supervisedInstance
+	err  error
+}
+
+type supervisor struct {
+	state     *State
+	instances []*supervisedInstance
+	exits     chan instanceExit
+	restarts  chan *supervisedInstance
+	running   int
+	pending   int
+}
+
+// Supervise starts the services and keeps them running, restarting crashed instances according to their restart policy.
+func Supervise(args []string) {
+	flags := newFlagSet("supervise")
+	daemon := flags.Bool("daemon", false, "run the supervisor in the background")
+	services, err := parseArgs(flags, args)
+	if err != nil {
+		PrintRed("Invalid supervise arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	InitForSSC()
+	if *daemon {
+		if err := daemonizeSupervisor(); err != nil {
+			PrintRed("Failed to start supervisor in the background: " + err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	if err := RunSupervisor(services); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+}
+
+// daemonizeSupervisor re-executes the current command without --daemon in a new session, logging to _output/logs.
+func daemonizeSupervisor() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var args []string
+	for _, arg := range os.Args[1:] {
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if strings.HasPrefix(arg, "-") && name == "daemon" {
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	logPath := filepath.Join(Paths.OutputLogs, SupervisorLogFile)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	PrintGreen(fmt.Sprintf("Supervisor started in the background, pid %d, log %s", cmd.Process.Pid, logPath))
+	return cmd.Process.Release()
+}
+
+// RunSupervisor starts the given services, or all configured ones, and supervises them until interrupted.
+func RunSupervisor(services []string) error {
+	if sup := runningSupervisor(); sup != nil {
+		return fmt.Errorf("a supervisor is already running with pid %d", sup.PID)
+	}
+
+	if len(services) == 0 {
+		PrintBlue("Starting tools primarily involves component verification and other preparatory tasks.")
+		if err := StartTools(); err != nil {
+			return fmt.Errorf("some tools failed to start, abort supervise: %v", err)
+		}
+		services = configuredServices()
+	} else {
+		for i, service := range services {
+			services[i] = withExeSuffix(service)
+		}
+	}
+
+	KillExistBinaries()
+	if err := attemptCheckBinaries(); err != nil {
+		return fmt.Errorf("some services running, abort supervise: %v", err)
+	}
+
+	if err := writeSupervisorPidFile(); err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(Paths.OutputTmp, SupervisorPidFile))
+
+	refused, err := verifyServiceBinaries(services)
+	if err != nil {
+		return err
+	}
+
+	state, err := LoadState()
+	if err != nil {
+		state = &State{}
+	}
+	s := &supervisor{
+		state:    state,
+		exits:    make(chan instanceExit),
+		restarts: make(chan *supervisedInstance),
+	}
+	waves, err := serviceWaves(services)
+	if err != nil {
+		return err
+	}
+	for i, wave := range waves {
+		var launching []*supervisedInstance
+		instances := make(instanceSelection)
+		for _, service := range wave {
+			if _, ok := refused[service]; ok {
+				PrintRed(fmt.Sprintf("Refusing to start %s, binary failed integrity verification.", service))
+				continue
+			}
+			binFullPath := GetBinFullPath(service)
+			checksum, _, err := fileSHA256(binFullPath)
+			if err != nil {
+				PrintRed(fmt.Sprintf("Binary not found: %s. Please build first.", binFullPath))
+				continue
+			}
+			cfg := getServiceConfig(service)
+			count := cfg.Count
+			if c, ok := serviceBinaries[service]; ok {
+				count = c
+			}
+			for i := 0; i < count; i++ {
+				inst := &supervisedInstance{service: service, index: i, config: cfg, checksum: checksum, backoff: cfg.Restart.Backoff}
+				s.instances = append(s.instances, inst)
+				launching = append(launching, inst)
+				instances[service] = append(instances[service], i)
+			}
+		}
+		// One log helper writes the logs of the whole wave, restarted instances get a helper of their own.
+		logs := openInstanceLogs(instances)
+		var started []*InstanceState
+		for _, inst := range launching {
+			if st := s.launch(inst, logs); st != nil {
+				started = append(started, st)
+			}
+		}
+		logs.Close()
+		if err := waitInstancesReady(started, i < len(waves)-1); err != nil {
+			PrintYellow(err.Error())
+		}
+	}
+	if len(s.instances) == 0 {
+		return errors.New("no services to supervise")
+	}
+	return s.run()
+}
+
+func (s *supervisor) run() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	PrintGreen(fmt.Sprintf("Supervising %d instances, press Ctrl+C to stop", len(s.instances)))
+	for {
+		if s.running == 0 && s.pending == 0 {
+			return errors.New("all supervised instances have exited and none will be restarted")
+		}
+		select {
+		case sig := <-signals:
+			PrintYellow(fmt.Sprintf("Received %s, stopping supervised instances", sig))
+			s.shutdown()
+			return nil
+		case exit := <-s.exits:
+			s.handleExit(exit)
+		case inst := <-s.restarts:
+			s.pending--
+			s.launch(inst, nil)
+		}
+	}
+}
+
+// launch starts an instance writing its output to logs and waits for it in the background, it returns nil when the
+// instance failed to start.
+func (s *supervisor) launch(inst *supervisedInstance, logs *instanceLogs) *InstanceState {
+	cmd, st, err := startInstance(inst.service, inst.index, inst.checksum, logs)
+	s.running++
+	if err != nil {
+		go func() { s.exits <- instanceExit{inst: inst, err: err} }()
+		return nil
+	}
+	inst.cmd = cmd
+	inst.started = time.Now()
+	st.Restarts = inst.total
+	s.state.Record(st)
+	if err := s.state.Save(); err != nil {
+		PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+	}
+	go func() {
+		err := cmd.Wait()
+		s.exits <- instanceExit{inst: inst, err: err}
+	}()
+	return st
+}
+
+func (s *supervisor) handleExit(exit instanceExit) {
+	s.running--
+	inst := exit.inst
+	inst.cmd = nil
+	name := fmt.Sprintf("%s[%d]", inst.service, inst.index)
+	if exit.err != nil {
+		PrintRed(fmt.Sprintf("%s exited: %v", name, exit.err))
+	} else {
+		PrintYellow(fmt.Sprintf("%s exited normally", name))
+	}
+
+	policy := inst.config.Restart
+	switch {
+	case policy.Policy == RestartNever, policy.Policy == RestartOnFailure && exit.err == nil:
+		PrintYellow(fmt.Sprintf("%s will not be restarted, restart policy is %s", name, policy.Policy))
+		return
+	}
+
+	now := time.Now()
+	recent := inst.restarts[:0]
+	for _, t := range inst.restarts {
+		if now.Sub(t) < policy.Window {
+			recent = append(recent, t)
+		}
+	}
+	inst.restarts = recent
+	if policy.MaxRestarts > 0 && len(inst.restarts) >= policy.MaxRestarts {
+		PrintRed(fmt.Sprintf("%s restarted %d times within %s, giving up", name, len(inst.restarts), policy.Window))
+		return
+	}
+
+	// An instance that stayed up longer than the maximum backoff is considered healthy again.
+	if !inst.started.IsZero() && now.Sub(inst.started) >= policy.MaxBackoff {
+		inst.backoff = policy.Backoff
+	}
+	delay := inst.backoff
+	inst.backoff *= 2
+	if inst.backoff > policy.MaxBackoff {
+		inst.backoff = policy.MaxBackoff
+	}
+	inst.restarts = append(inst.restarts, now)
+	inst.total++
+	s.pending++
+
+	PrintBlue(fmt.Sprintf("Restarting %s in %s (restart %d)", name, delay, inst.total))
+	time.AfterFunc(delay, func() { s.restarts <- inst })
+}
+
+// shutdown gracefully stops all running instances, killing those that exceed their stop timeout.
+func (s *supervisor) shutdown() {
+	procs := make(map[string][]*process.Process)
+	for _, inst := range s.instances {
+		if inst.cmd != nil {
+			if p, err := process.NewProcess(int32(inst.cmd.Process.Pid)); err == nil {
+				procs[inst.service] = append(procs[inst.service], p)
+			}
+		}
+	}
+
+	// Exits must be received while stopping, so the instances are reaped and their exit is noticed.
+	stopped := make(chan struct{})
+	go func() {
+		stopServiceProcessesInOrder(procs)
+		close(stopped)
+	}()
+	for s.running > 0 || stopped != nil {
+		select {
+		case exit := <-s.exits:
+			s.running--
+			exit.inst.cmd = nil
+		case <-s.restarts:
+			s.pending--
+		case <-stopped:
+			stopped = nil
+		}
+	}
+	if err := s.state.Save(); err != nil {
+		PrintYellow(fmt.Sprintf("Failed to update state file: %v", err))
+	}
+	PrintGreen("All supervised instances have been stopped")
+}
+
+// verifyServiceBinaries verifies the existing binaries of the given services when verification is enabled.
+func verifyServiceBinaries(services []string) (map[string]error, error) {
+	if !verifyBinaries {
+		return nil, nil
+	}
+	paths := make(map[string]string)
+	for _, service := range services {
+		binFullPath := GetBinFullPath(service)
+		if _, err := os.Stat(binFullPath); err == nil {
+			paths[service] = binFullPath
+		}
+	}
+	refused, err := VerifyBinaries(paths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify binaries: %v", err)
+	}
+	return refused, nil
+}
+
+func writeSupervisorPidFile() error {
+	exe, _ := os.Executable()
+	inst := newInstanceState("supervisor", 0, os.Getpid(), exe, "", os.Args[1:])
+	data, err := json.MarshalIndent(inst, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(Paths.OutputTmp, SupervisorPidFile), data, 0644)
+}
+
+// runningSupervisor returns the record of a running supervisor other than the current process.
+func runningSupervisor() *InstanceState {
+	data, err := os.ReadFile(filepath.Join(Paths.OutputTmp, SupervisorPidFile))
+	if err != nil {
+		return nil
+	}
+	var inst InstanceState
+	if err := json.Unmarshal(data, &inst); err != nil || inst.PID == os.Getpid() {
+		return nil
+	}
+	if inst.Process() == nil {
+		return nil
+	}
+	return &inst
+}
+
+// stopSupervisor stops a running supervisor, which in turn stops its instances in order, so they aren't restarted
+// behind our back. It gets the longest stop timeout of the services plus a margin for that. The supervisor isn't
+// stopped through stopProcess, which would kill its instances as stragglers; when it doesn't stop in time only the
+// supervisor is killed and its remaining instances are stopped gracefully afterwards.
+func stopSupervisor() {
+	sup := runningSupervisor()
+	if sup == nil {
+		return
+	}
+	p := sup.Process()
+	cfg := StopConfig{Signal: "SIGTERM", Timeout: maxStopTimeout() + supervisorStopMargin}
+	PrintBlue(fmt.Sprintf("Stopping supervisor, pid %d", sup.PID))
+	if err := sendStopSignal(p, cfg.Signal); err != nil && !processExited(p) {
+		PrintYellow(fmt.Sprintf("Failed to send %s to supervisor pid %d: %v", cfg.Signal, sup.PID, err))
+	} else {
+		deadline := time.Now().Add(cfg.Timeout)
+		for time.Now().Before(deadline) {
+			if processExited(p) {
+				return
+			}
+			time.Sleep(stopPollInterval)
+		}
+	}
+
+	PrintRed(fmt.Sprintf("Supervisor pid %d did not stop, killing it and stopping its instances", sup.PID))
+	if err := p.Kill(); err != nil && !processExited(p) {
+		PrintRed(fmt.Sprintf("Failed to kill supervisor pid %d: %v", sup.PID, err))
+		return
+	}
+	procs, err := serviceProcesses(configuredServices())
+	if err != nil {
+		PrintRed(fmt.Sprintf("Failed to get processes: %v", err))
+		return
+	}
+	stopServiceProcessesInOrder(procs)
+}
+
+// withExeSuffix appends .exe on Windows, matching the keys of serviceBinaries.
+func withExeSuffix(binary string) string {
+	if runtime.GOOS == "windows" && !strings.HasSuffix(binary, ".exe") {
+		return binary + ".exe"
+	}
+	return binary
+}
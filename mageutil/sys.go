@@ -3,6 +3,7 @@ package mageutil
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 
@@ -126,88 +127,23 @@ func PrintBinaryPorts(binaryPath string, pidMap map[string][]int) {
 	}
 }
 
+// BatchKillExistBinaries stops the instances of the given binaries.
 func BatchKillExistBinaries(binaryPaths []string) {
-	processes, err := process.Processes()
-	if err != nil {
-		fmt.Printf("Failed to get processes: %v\n", err)
-		return
-	}
-
-	exePathMap := make(map[string][]*process.Process)
-	for _, p := range processes {
-		exePath, err := p.Exe()
-		if err != nil {
-			continue // Skip processes where the executable path cannot be determined
-		}
-		exePathMap[exePath] = append(exePathMap[exePath], p)
-	}
-
 	for _, binaryPath := range binaryPaths {
-		if procs, found := exePathMap[binaryPath]; found {
-			fmt.Println("binaryPath  found ", binaryPath)
-			for _, p := range procs {
-				terminateAndKillProcess(p)
-			}
-		}
-	}
-}
-
-func terminateAndKillProcess(p *process.Process) {
-	cmdline, err := p.Cmdline()
-	if err != nil {
-		fmt.Printf("Failed to get command line for process %d: %v\n", p.Pid, err)
-		return
-	}
-
-	err = p.Terminate()
-	if err != nil {
-		err = p.Kill() // Fallback to kill if terminate fails
-		if err != nil {
-			fmt.Printf("Failed to kill process cmdline: %s, pid: %d, err: %v\n", cmdline, p.Pid, err)
-		} else {
-			fmt.Printf("Killed process cmdline: %s, pid: %d\n", cmdline, p.Pid)
-		}
-	} else {
-		fmt.Printf("Terminated process cmdline: %s, pid: %d\n", cmdline, p.Pid)
+		KillExistBinary(binaryPath)
 	}
 }
 
-// KillExistBinary kills all processes matching the given binary file path.
+// KillExistBinary stops the instances of the given binary, identified like `mage stop` does.
 func KillExistBinary(binaryPath string) {
-	processes, err := process.Processes()
+	service := filepath.Base(binaryPath)
+	procs, err := serviceProcesses([]string{service})
 	if err != nil {
 		fmt.Printf("Failed to get processes: %v\n", err)
 		return
 	}
-
-	for _, p := range processes {
-		exePath, err := p.Exe()
-		if err != nil {
-			continue
-		}
-
-		if strings.Contains(exePath, binaryPath) {
-
-			//if strings.EqualFold(exePath, binaryPath) {
-			cmdline, err := p.Cmdline()
-			if err != nil {
-				fmt.Printf("Failed to get command line for process %d: %v\n", p.Pid, err)
-				continue
-			}
-
-			err = p.Terminate()
-			if err != nil {
-
-				err = p.Kill()
-				if err != nil {
-					fmt.Printf("Failed to kill process cmdline: %s, pid: %d, err: %v\n", cmdline, p.Pid, err)
-				} else {
-					fmt.Printf("Killed process cmdline: %s, pid: %d\n", cmdline, p.Pid)
-				}
-			} else {
-				fmt.Printf("Terminated process cmdline: %s, pid: %d\n", cmdline, p.Pid)
-			}
-		}
+	for _, p := range procs[service] {
+		stopProcess(service, p, getServiceConfig(service).Stop)
 	}
 }
 
@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd && !windows
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd,!windows
+
+package mageutil
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func enableRawTerminal() (func(), error) {
+	return nil, fmt.Errorf("interactive terminals are not supported on %s", runtime.GOOS)
+}
+
+func terminalSize(f *os.File) (int, int, error) {
+	return 0, 0, fmt.Errorf("interactive terminals are not supported on %s", runtime.GOOS)
+}
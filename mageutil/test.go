@@ -0,0 +1,611 @@
+package mageutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	testJUnitFile    = "junit.xml"
+	testSummaryFile  = "summary.json"
+	testCoverageFile = "coverage.out"
+)
+
+// TestOptions controls how `mage test` runs go test.
+type TestOptions struct {
+	Race  bool // Run with the race detector
+	Cover bool // Collect coverage profiles and merge them into a single file
+}
+
+// testEvent is a single line of `go test -json` output.
+type testEvent struct {
+	Time       time.Time `json:"Time"`
+	Action     string    `json:"Action"`
+	Package    string    `json:"Package"`
+	ImportPath string    `json:"ImportPath"`
+	Test       string    `json:"Test"`
+	Elapsed    float64   `json:"Elapsed"`
+	Output     string    `json:"Output"`
+}
+
+type testCaseResult struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Elapsed float64 `json:"elapsed"`
+	output  strings.Builder
+}
+
+type testPackageResult struct {
+	Package string            `json:"package"`
+	Module  string            `json:"module"`
+	Status  string            `json:"status"`
+	Elapsed float64           `json:"elapsed"`
+	Tests   int               `json:"tests"`
+	Passed  int               `json:"passed"`
+	Failed  int               `json:"failed"`
+	Skipped int               `json:"skipped"`
+	Cases   []*testCaseResult `json:"-"`
+	output  strings.Builder
+	index   map[string]*testCaseResult
+}
+
+type testModuleResult struct {
+	Dir      string
+	Packages []*testPackageResult
+	Stderr   string
+	Coverage string
+	Err      error
+}
+
+// TestSummary is written as JSON next to the JUnit report.
+type TestSummary struct {
+	StartedAt time.Time            `json:"startedAt"`
+	Duration  float64              `json:"duration"`
+	Race      bool                 `json:"race"`
+	Coverage  string               `json:"coverage,omitempty"`
+	Modules   []string             `json:"modules"`
+	Tests     int                  `json:"tests"`
+	Passed    int                  `json:"passed"`
+	Failed    int                  `json:"failed"`
+	Skipped   int                  `json:"skipped"`
+	Packages  []*testPackageResult `json:"packages"`
+	Errors    []string             `json:"errors,omitempty"`
+}
+
+// Test runs go test for the packages imported by the specified binaries, or for every module in the project.
+func Test(args []string, pathOpts *PathOptions) {
+	flags := newFlagSet("test")
+	opts := &TestOptions{}
+	flags.BoolVar(&opts.Race, "race", false, "enable the race detector")
+	flags.BoolVar(&opts.Cover, "cover", false, "collect and merge coverage profiles")
+	binaries, err := parseArgs(flags, args)
+	if err != nil {
+		PrintRed("Invalid test arguments: " + err.Error())
+		os.Exit(1)
+	}
+
+	if pathOpts != nil {
+		if err := UpdateGlobalPaths(pathOpts); err != nil {
+			PrintRed("Failed to update paths: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
+	if err := RunTests(binaries, opts); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+	PrintGreen("All tests passed.")
+}
+
+// RunTests runs the tests and writes the JUnit report, JSON summary and merged coverage profile to _output/tmp/test.
+func RunTests(binaries []string, opts *TestOptions) error {
+	if opts == nil {
+		opts = &TestOptions{}
+	}
+	outputDir := filepath.Join(Paths.OutputTmp, TestDir)
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", outputDir, err)
+	}
+
+	targets, err := resolveTestTargets(binaries)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		PrintYellow("No Go modules found to test.")
+		return nil
+	}
+
+	modDirs := make([]string, 0, len(targets))
+	for dir := range targets {
+		modDirs = append(modDirs, dir)
+	}
+	sort.Strings(modDirs)
+
+	startedAt := time.Now()
+	results := make([]*testModuleResult, len(modDirs))
+	var wg sync.WaitGroup
+	for i, dir := range modDirs {
+		wg.Add(1)
+		go func(i int, dir string) {
+			defer wg.Done()
+			var coverProfile string
+			if opts.Cover {
+				coverProfile = filepath.Join(outputDir, fmt.Sprintf("coverage-%d.out", i))
+			}
+			PrintBlue(fmt.Sprintf("Testing module %s ...", dir))
+			results[i] = runModuleTests(dir, targets[dir], opts.Race, coverProfile)
+		}(i, dir)
+	}
+	wg.Wait()
+
+	summary := &TestSummary{
+		StartedAt: startedAt,
+		Duration:  time.Since(startedAt).Seconds(),
+		Race:      opts.Race,
+		Modules:   modDirs,
+	}
+	var coverProfiles []string
+	for _, res := range results {
+		if res.Err != nil {
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", res.Dir, res.Err))
+		}
+		if res.Coverage != "" {
+			coverProfiles = append(coverProfiles, res.Coverage)
+		}
+		for _, pkg := range res.Packages {
+			summary.Packages = append(summary.Packages, pkg)
+			summary.Tests += pkg.Tests
+			summary.Passed += pkg.Passed
+			summary.Failed += pkg.Failed
+			summary.Skipped += pkg.Skipped
+		}
+	}
+
+	if len(coverProfiles) > 0 {
+		coveragePath := filepath.Join(outputDir, testCoverageFile)
+		if err := mergeCoverProfiles(coverProfiles, coveragePath); err != nil {
+			summary.Errors = append(summary.Errors, err.Error())
+		} else {
+			summary.Coverage = coveragePath
+			for _, profile := range coverProfiles {
+				os.Remove(profile)
+			}
+		}
+	}
+
+	if err := writeJUnitReport(filepath.Join(outputDir, testJUnitFile), summary); err != nil {
+		return err
+	}
+	if err := writeTestSummary(filepath.Join(outputDir, testSummaryFile), summary); err != nil {
+		return err
+	}
+
+	printTestSummary(summary)
+	PrintBlue(fmt.Sprintf("Test reports written to %s", outputDir))
+
+	var failedPackages []string
+	for _, pkg := range summary.Packages {
+		if pkg.Status == "fail" {
+			failedPackages = append(failedPackages, pkg.Package)
+		}
+	}
+	if len(failedPackages) > 0 || len(summary.Errors) > 0 {
+		msg := "tests failed"
+		if len(failedPackages) > 0 {
+			msg += " in packages: " + strings.Join(failedPackages, ", ")
+		}
+		if len(summary.Errors) > 0 {
+			msg += "\n" + strings.Join(summary.Errors, "\n")
+		}
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// resolveTestTargets maps Go module directories to the package patterns to test in them.
+func resolveTestTargets(binaries []string) (map[string][]string, error) {
+	targets := make(map[string][]string)
+	if len(binaries) == 0 {
+		for _, dir := range findGoModules(Paths.Root) {
+			targets[dir] = []string{"./..."}
+		}
+		return targets, nil
+	}
+
+	seen := make(map[string]map[string]bool)
+	for _, binary := range binaries {
+		relPath, found := isCmdBinary(binary)
+		if !found {
+			relPath, found = isToolBinary(binary)
+		}
+		if !found {
+			PrintYellow(fmt.Sprintf("Binary %s not found in cmd (%s) or tools (%s) directories. Skipping...", binary, Paths.SrcDir, Paths.ToolsDir))
+			continue
+		}
+
+		binaryDir := filepath.Join(Paths.Root, relPath)
+		goModDir := findGoModDir(binaryDir)
+		if goModDir == "" {
+			return nil, fmt.Errorf("no go.mod found for binary %s", binary)
+		}
+		pkgs, err := listLocalDeps(goModDir, binaryDir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list packages imported by %s: %w", binary, err)
+		}
+		if seen[goModDir] == nil {
+			seen[goModDir] = make(map[string]bool)
+		}
+		for _, pkg := range pkgs {
+			if !seen[goModDir][pkg] {
+				seen[goModDir][pkg] = true
+				targets[goModDir] = append(targets[goModDir], pkg)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// listLocalDeps returns the packages of the main module in goModDir that the package in pkgDir depends on, including itself.
+func listLocalDeps(goModDir, pkgDir string) ([]string, error) {
+	relPath, err := filepath.Rel(goModDir, pkgDir)
+	if err != nil {
+		return nil, err
+	}
+	format := "{{if and (not .Standard) .Module}}{{if .Module.Main}}{{.ImportPath}}{{end}}{{end}}"
+	cmd := exec.Command("go", "list", "-deps", "-f", format, "./"+filepath.ToSlash(relPath))
+	cmd.Dir = goModDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var pkgs []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			pkgs = append(pkgs, line)
+		}
+	}
+	return pkgs, nil
+}
+
+// findGoModules returns every directory under root containing a go.mod, skipping the output directory and hidden, vendor and testdata directories.
+func findGoModules(root string) []string {
+	var dirs []string
+	outputDir := filepath.Clean(Paths.Output)
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			name := d.Name()
+			if path != root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata") {
+				return filepath.SkipDir
+			}
+			if filepath.Clean(path) == outputDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Name() == "go.mod" {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	return dirs
+}
+
+// runModuleTests runs go test in a single module and collects the results from its JSON output.
+func runModuleTests(dir string, pkgs []string, race bool, coverProfile string) *testModuleResult {
+	result := &testModuleResult{Dir: dir}
+
+	args := []string{"test", "-json"}
+	if race {
+		args = append(args, "-race")
+	}
+	if coverProfile != "" {
+		args = append(args, "-coverprofile="+coverProfile)
+	}
+	args = append(args, pkgs...)
+
+	cmd := exec.Command("go", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+	result.Stderr = stderr.String()
+
+	packages := make(map[string]*testPackageResult)
+	var order []string
+	getPackage := func(name string) *testPackageResult {
+		pkg, ok := packages[name]
+		if !ok {
+			pkg = &testPackageResult{Package: name, Module: dir, index: make(map[string]*testCaseResult)}
+			packages[name] = pkg
+			order = append(order, name)
+		}
+		return pkg
+	}
+
+	scanner := bufio.NewScanner(&stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var ev testEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		switch {
+		case ev.Action == "build-output" || ev.Action == "build-fail":
+			pkg := getPackage(strings.Fields(ev.ImportPath + " ")[0])
+			pkg.output.WriteString(ev.Output)
+			if ev.Action == "build-fail" {
+				pkg.Status = "fail"
+			}
+		case ev.Package == "":
+			continue
+		case ev.Test == "":
+			pkg := getPackage(ev.Package)
+			switch ev.Action {
+			case "output":
+				pkg.output.WriteString(ev.Output)
+			case "pass", "fail", "skip":
+				pkg.Status = ev.Action
+				pkg.Elapsed = ev.Elapsed
+			}
+		default:
+			pkg := getPackage(ev.Package)
+			tc, ok := pkg.index[ev.Test]
+			if !ok {
+				tc = &testCaseResult{Name: ev.Test}
+				pkg.index[ev.Test] = tc
+				pkg.Cases = append(pkg.Cases, tc)
+			}
+			switch ev.Action {
+			case "output":
+				tc.output.WriteString(ev.Output)
+			case "pass", "fail", "skip":
+				tc.Status = ev.Action
+				tc.Elapsed = ev.Elapsed
+			}
+		}
+	}
+
+	for _, name := range order {
+		pkg := packages[name]
+		for _, tc := range pkg.Cases {
+			pkg.Tests++
+			switch tc.Status {
+			case "pass":
+				pkg.Passed++
+			case "skip":
+				pkg.Skipped++
+			default:
+				// A test without a final action was interrupted, e.g. by a panic or timeout.
+				if tc.Status == "" {
+					tc.Status = "fail"
+				}
+				pkg.Failed++
+			}
+		}
+		if pkg.Status == "" {
+			pkg.Status = "fail"
+		}
+		result.Packages = append(result.Packages, pkg)
+	}
+
+	if runErr != nil && len(result.Packages) == 0 {
+		result.Err = fmt.Errorf("go test failed: %v: %s", runErr, strings.TrimSpace(result.Stderr))
+	}
+	if coverProfile != "" {
+		if _, err := os.Stat(coverProfile); err == nil {
+			result.Coverage = coverProfile
+		}
+	}
+	return result
+}
+
+// mergeCoverProfiles merges several coverage profiles into one, summing the counts of blocks seen in more than one profile.
+func mergeCoverProfiles(profiles []string, output string) error {
+	mode := ""
+	counts := make(map[string]int64)
+	var blocks []string
+
+	for _, profile := range profiles {
+		file, err := os.Open(profile)
+		if err != nil {
+			return fmt.Errorf("failed to open coverage profile %s: %w", profile, err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if strings.HasPrefix(line, "mode:") {
+				m := strings.TrimSpace(strings.TrimPrefix(line, "mode:"))
+				if mode == "" {
+					mode = m
+				} else if mode != m {
+					file.Close()
+					return fmt.Errorf("coverage profile %s uses mode %s, expected %s", profile, m, mode)
+				}
+				continue
+			}
+			sep := strings.LastIndex(line, " ")
+			if sep < 0 {
+				continue
+			}
+			block, countStr := line[:sep], line[sep+1:]
+			count, err := strconv.ParseInt(countStr, 10, 64)
+			if err != nil {
+				continue
+			}
+			prev, exists := counts[block]
+			if !exists {
+				blocks = append(blocks, block)
+			}
+			if mode == "set" {
+				if count > prev {
+					counts[block] = count
+				}
+			} else {
+				counts[block] = prev + count
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read coverage profile %s: %w", profile, err)
+		}
+	}
+
+	if mode == "" {
+		mode = "set"
+	}
+	sort.Strings(blocks)
+	lines := make([]string, 0, len(blocks)+1)
+	lines = append(lines, "mode: "+mode)
+	for _, block := range blocks {
+		lines = append(lines, fmt.Sprintf("%s %d", block, counts[block]))
+	}
+	return writeLines(lines, output)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Content string `xml:",chardata"`
+}
+
+func writeJUnitReport(path string, summary *TestSummary) error {
+	report := junitTestSuites{
+		Tests:    summary.Tests,
+		Failures: summary.Failed,
+		Skipped:  summary.Skipped,
+		Time:     formatSeconds(summary.Duration),
+	}
+	timestamp := summary.StartedAt.Format(time.RFC3339)
+	for _, pkg := range summary.Packages {
+		suite := junitTestSuite{
+			Name:      pkg.Package,
+			Tests:     pkg.Tests,
+			Failures:  pkg.Failed,
+			Skipped:   pkg.Skipped,
+			Time:      formatSeconds(pkg.Elapsed),
+			Timestamp: timestamp,
+		}
+		// A package can fail without any failing test, e.g. on build errors or a panic in TestMain.
+		if pkg.Status == "fail" && pkg.Failed == 0 {
+			suite.Errors = 1
+			suite.SystemOut = pkg.output.String()
+		}
+		for _, tc := range pkg.Cases {
+			c := junitTestCase{
+				Name:      tc.Name,
+				Classname: pkg.Package,
+				Time:      formatSeconds(tc.Elapsed),
+			}
+			switch tc.Status {
+			case "fail":
+				c.Failure = &junitMessage{Message: "Failed", Content: tc.output.String()}
+			case "skip":
+				c.Skipped = &junitMessage{Message: "Skipped", Content: tc.output.String()}
+			}
+			suite.Cases = append(suite.Cases, c)
+		}
+		report.Suites = append(report.Suites, suite)
+	}
+
+	data, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JUnit report: %w", err)
+	}
+	data = append([]byte(xml.Header), data...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write JUnit report: %w", err)
+	}
+	return nil
+}
+
+func writeTestSummary(path string, summary *TestSummary) error {
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode test summary: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write test summary: %w", err)
+	}
+	return nil
+}
+
+func printTestSummary(summary *TestSummary) {
+	for _, pkg := range summary.Packages {
+		line := fmt.Sprintf("%-4s %s (%d tests, %.2fs)", strings.ToUpper(pkg.Status), pkg.Package, pkg.Tests, pkg.Elapsed)
+		switch pkg.Status {
+		case "pass":
+			PrintGreenNoTimeStamp(line)
+		case "fail":
+			PrintRedNoTimeStamp(line)
+			for _, tc := range pkg.Cases {
+				if tc.Status == "fail" {
+					PrintRedNoTimeStamp("    --- FAIL: " + tc.Name)
+				}
+			}
+		default:
+			fmt.Println(line)
+		}
+	}
+	PrintBlue(fmt.Sprintf("Tests: %d, passed: %d, failed: %d, skipped: %d, duration: %.2fs",
+		summary.Tests, summary.Passed, summary.Failed, summary.Skipped, summary.Duration))
+	if summary.Coverage != "" {
+		PrintBlue("Merged coverage profile: " + summary.Coverage)
+	}
+}
+
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
@@ -0,0 +1,446 @@
+package mageutil
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	topRefreshInterval = time.Second
+	topLogTailBytes    = 64 * 1024
+)
+
+// topColumn is a column of `mage top`, sorted by its number key.
+type topColumn struct {
+	title string
+	width int
+	value func(*InstanceStatus) string
+	less  func(a, b *InstanceStatus) bool
+}
+
+var topColumns = []topColumn{
+	{"INSTANCE", 28, func(s *InstanceStatus) string {
+		return fmt.Sprintf("%s[%d]", strings.TrimSuffix(s.Service, ".exe"), s.Index)
+	},
+		func(a, b *InstanceStatus) bool {
+			if a.Service != b.Service {
+				return a.Service < b.Service
+			}
+			return a.Index < b.Index
+		}},
+	{"PID", 8, func(s *InstanceStatus) string { return formatCount(s.PID) }, func(a, b *InstanceStatus) bool { return a.PID < b.PID }},
+	{"CPU%", 7, func(s *InstanceStatus) string { return formatPercent(s.CPUPercent) }, func(a, b *InstanceStatus) bool { return a.CPUPercent < b.CPUPercent }},
+	{"RSS", 10, func(s *InstanceStatus) string { return formatBytes(s.RSSBytes) }, func(a, b *InstanceStatus) bool { return a.RSSBytes < b.RSSBytes }},
+	{"THREADS", 10, func(s *InstanceStatus) string { return formatCount(s.Threads) }, func(a, b *InstanceStatus) bool { return a.Threads < b.Threads }},
+	{"FDS", 12, formatFDUsage, func(a, b *InstanceStatus) bool { return a.OpenFDs < b.OpenFDs }},
+	{"CONNS", 8, func(s *InstanceStatus) string {
+		if s.process == nil {
+			return "-"
+		}
+		return strconv.Itoa(s.Connections)
+	}, func(a, b *InstanceStatus) bool { return a.Connections < b.Connections }},
+	{"UPTIME", 10, func(s *InstanceStatus) string { return formatUptime(s.UptimeSeconds) }, func(a, b *InstanceStatus) bool { return a.UptimeSeconds < b.UptimeSeconds }},
+	{"PORTS", 16, func(s *InstanceStatus) string { return formatPorts(s.Ports) }, func(a, b *InstanceStatus) bool {
+		return len(a.Ports) > 0 && (len(b.Ports) == 0 || a.Ports[0] < b.Ports[0])
+	}},
+}
+
+// topView is the state of the `mage top` screen.
+type topView struct {
+	out       *os.File // The terminal, os.Stdout is redirected to the message line while the view is shown
+	sampler   *cpuSampler
+	statuses  []*InstanceStatus
+	sortBy    int
+	desc      bool
+	selected  string // Instance column of the selected row, kept across refreshes
+	offset    int    // First row shown when the rows don't fit
+	showLogs  bool
+	message   string
+	busy      bool
+	messages  chan string // Output of actions, shown on the message line
+	done      chan string // Result of the running action
+	collectAt time.Time
+}
+
+// Top shows the resource usage of the instances in a terminal view refreshed every second.
+func Top(args []string) {
+	flags := newFlagSet("top")
+	if _, err := parseArgs(flags, args); err != nil {
+		PrintRed("Invalid top arguments: " + err.Error())
+		os.Exit(1)
+	}
+	InitForSSC()
+	if err := runTop(); err != nil {
+		PrintRed(err.Error())
+		os.Exit(1)
+	}
+}
+
+func runTop() error {
+	restore, err := enableRawTerminal()
+	if err != nil {
+		return fmt.Errorf("mage top needs an interactive terminal: %v", err)
+	}
+	view := &topView{out: os.Stdout, sampler: newCPUSampler(), sortBy: 2, desc: true, messages: make(chan string, 16), done: make(chan string)}
+
+	// Output of restarts and stops goes to the message line instead of the screen.
+	r, w, err := os.Pipe()
+	if err != nil {
+		restore()
+		return err
+	}
+	os.Stdout = w
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			view.messages <- stripANSI(scanner.Text())
+		}
+	}()
+	fmt.Fprint(view.out, "\033[?1049h\033[?25l")
+	defer func() {
+		fmt.Fprint(view.out, "\033[?25h\033[?1049l")
+		os.Stdout = view.out
+		w.Close()
+		restore()
+	}()
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+	ticker := time.NewTicker(topRefreshInterval)
+	defer ticker.Stop()
+
+	view.refresh()
+	for {
+		view.render()
+		select {
+		case key, ok := <-keys:
+			if !ok || !view.handleKey(key) {
+				return nil
+			}
+		case message := <-view.messages:
+			// Output arriving after the result of the action doesn't replace it.
+			if view.busy {
+				view.message = message
+			}
+		case message := <-view.done:
+			view.busy = false
+			view.message = message
+			view.refresh()
+		case <-ticker.C:
+			view.refresh()
+		}
+	}
+}
+
+// readKeys sends each key press, escape sequences such as the arrow keys as one key, and closes keys at EOF.
+func readKeys(in io.Reader, keys chan<- string) {
+	buf := make([]byte, 16)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			keys <- string(buf[:n])
+		}
+		if err != nil {
+			close(keys)
+			return
+		}
+	}
+}
+
+// handleKey applies a key press and reports whether the view keeps running.
+func (v *topView) handleKey(key string) bool {
+	switch key {
+	case "q", "Q", "\x03", "\x1b":
+		return false
+	case "\x1b[A", "\x1bOA", "k":
+		v.move(-1)
+	case "\x1b[B", "\x1bOB", "j":
+		v.move(1)
+	case "l", "L":
+		v.showLogs = !v.showLogs
+	case "r", "R":
+		v.act("Restarting", restartInstance)
+	case "s", "S":
+		v.act("Stopping", stopInstance)
+	case "<", ">":
+		delta := 1
+		if key == "<" {
+			delta = len(topColumns) - 1
+		}
+		v.sortBy = (v.sortBy + delta) % len(topColumns)
+		v.sortStatuses()
+	default:
+		if n, err := strconv.Atoi(key); err == nil && n >= 1 && n <= len(topColumns) {
+			if v.sortBy == n-1 {
+				v.desc = !v.desc
+			} else {
+				v.sortBy, v.desc = n-1, n-1 != 0
+			}
+			v.sortStatuses()
+		}
+	}
+	return true
+}
+
+func (v *topView) refresh() {
+	statuses, err := collectInstanceStatuses(v.sampler, false)
+	if err != nil {
+		v.message = err.Error()
+		return
+	}
+	v.statuses = statuses
+	v.collectAt = time.Now()
+	v.sortStatuses()
+}
+
+func (v *topView) sortStatuses() {
+	less := topColumns[v.sortBy].less
+	sort.SliceStable(v.statuses, func(i, j int) bool {
+		if v.desc {
+			return less(v.statuses[j], v.statuses[i])
+		}
+		return less(v.statuses[i], v.statuses[j])
+	})
+	if v.selectedIndex() < 0 && len(v.statuses) > 0 {
+		v.selected = topColumns[0].value(v.statuses[0])
+	}
+}
+
+func (v *topView) selectedIndex() int {
+	for i, s := range v.statuses {
+		if topColumns[0].value(s) == v.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+func (v *topView) selectedStatus() *InstanceStatus {
+	if i := v.selectedIndex(); i >= 0 {
+		return v.statuses[i]
+	}
+	return nil
+}
+
+func (v *topView) move(delta int) {
+	i := v.selectedIndex() + delta
+	if i >= 0 && i < len(v.statuses) {
+		v.selected = topColumns[0].value(v.statuses[i])
+	}
+}
+
+// act runs an action on the selected instance in the background, one at a time.
+func (v *topView) act(verb string, action func(service string, index int) error) {
+	s := v.selectedStatus()
+	if s == nil {
+		return
+	}
+	if v.busy {
+		v.message = "Another action is still running"
+		return
+	}
+	v.busy = true
+	name := topColumns[0].value(s)
+	v.message = fmt.Sprintf("%s %s...", verb, name)
+	go func() {
+		if err := action(s.Service, s.Index); err != nil {
+			v.done <- fmt.Sprintf("%s %s failed: %v", verb, name, err)
+		} else {
+			v.done <- fmt.Sprintf("%s %s done", verb, name)
+		}
+	}()
+}
+
+// stopInstance stops instance index of a service.
+func stopInstance(service string, index int) error {
+	procs, err := instanceProcesses(service)
+	if err != nil {
+		return err
+	}
+	p, ok := procs[index]
+	if !ok {
+		return fmt.Errorf("%s[%d] is not running", service, index)
+	}
+	stopServiceProcesses(map[string][]*process.Process{service: {p}})
+	pruneStateFile()
+	if sup := runningSupervisor(); sup != nil {
+		PrintYellow(fmt.Sprintf("The supervisor with pid %d may restart %s[%d]", sup.PID, service, index))
+	}
+	return nil
+}
+
+func (v *topView) render() {
+	width, height, err := terminalSize(v.out)
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 120, 40
+	}
+	var lines []string
+	add := func(line string) { lines = append(lines, truncateRunes(line, width)) }
+
+	running := 0
+	for _, s := range v.statuses {
+		if s.process != nil {
+			running++
+		}
+	}
+	order, marker := "ascending", "^"
+	if v.desc {
+		order, marker = "descending", "v"
+	}
+	add(fmt.Sprintf("gomake top - %s, %d of %d instances running, sorted by %s %s",
+		v.collectAt.Format(time.TimeOnly), running, len(v.statuses), topColumns[v.sortBy].title, order))
+	add("")
+	var header strings.Builder
+	for i, c := range topColumns {
+		title := fmt.Sprintf("%d:%s", i+1, c.title)
+		if i == v.sortBy {
+			title += marker
+		}
+		header.WriteString(padRunes(title, c.width))
+	}
+	add(header.String())
+
+	// The table takes the rows left by the header, the log pane and the two footer lines.
+	logRows := 0
+	if v.showLogs {
+		logRows = height / 3
+	}
+	rows := height - len(lines) - 2
+	if v.showLogs {
+		rows -= logRows + 1
+	}
+	if rows < 1 {
+		rows = 1
+	}
+	selected := v.selectedIndex()
+	if selected < v.offset {
+		v.offset = selected
+	}
+	if selected >= v.offset+rows {
+		v.offset = selected - rows + 1
+	}
+	if v.offset < 0 {
+		v.offset = 0
+	}
+	for i := v.offset; i < v.offset+rows; i++ {
+		if i >= len(v.statuses) {
+			add("")
+			continue
+		}
+		var row strings.Builder
+		for _, c := range topColumns {
+			row.WriteString(padRunes(c.value(v.statuses[i]), c.width))
+		}
+		line := padRunes(truncateRunes(row.String(), width), width+1)
+		if i == selected {
+			line = "\033[7m" + line + "\033[0m"
+		}
+		lines = append(lines, line)
+	}
+
+	if v.showLogs {
+		var tail []string
+		if s := v.selectedStatus(); s != nil {
+			path := instanceLogPath(s.Service, s.Index)
+			add(fmt.Sprintf("--- %s: %s ---", topColumns[0].value(s), path))
+			tail = tailLines(path, logRows)
+		} else {
+			add("---")
+		}
+		for i := 0; i < logRows; i++ {
+			if i < len(tail) {
+				add(stripANSI(tail[i]))
+			} else {
+				add("")
+			}
+		}
+	}
+	add("up/down select, 1-9 or </> sort, r restart, s stop, l logs, q quit")
+	add(v.message)
+
+	var b strings.Builder
+	b.WriteString("\033[H")
+	for i, line := range lines {
+		if i >= height {
+			break
+		}
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+		b.WriteString("\033[K")
+	}
+	b.WriteString("\033[J")
+	fmt.Fprint(v.out, b.String())
+}
+
+func formatFDUsage(s *InstanceStatus) string {
+	if s.OpenFDs < 0 {
+		return "-"
+	}
+	if s.FDLimit > 0 {
+		return fmt.Sprintf("%d/%d", s.OpenFDs, s.FDLimit)
+	}
+	return strconv.Itoa(int(s.OpenFDs))
+}
+
+// tailLines returns the last n lines of a file.
+func tailLines(path string, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > topLogTailBytes {
+		f.Seek(-topLogTailBytes, io.SeekEnd)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(strings.ReplaceAll(line, "\t", "    "), "\r")
+	}
+	return lines
+}
+
+// stripANSI removes color escape sequences from a line.
+func stripANSI(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\033' && i+1 < len(s) && s[i+1] == '[' {
+			i += 2
+			for i < len(s) && (s[i] < '@' || s[i] > '~') {
+				i++
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func truncateRunes(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+func padRunes(s string, width int) string {
+	s = truncateRunes(s, width-1)
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}